@@ -0,0 +1,79 @@
+package main
+
+// A bloom filter is written in every SST file (since sysVersFilter), so that a lookup can skip the files that cannot hold the key
+// without reading them.
+
+// Structure of the filter block:
+// 1. Bit array (variable length)
+// 2. Number of hash functions (1 byte)
+
+import (
+	"hash/fnv"
+)
+
+type bloomFilter struct {
+	bits []byte
+	k    uint8
+}
+
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// newBloomFilter builds the filter of the given key hashes, using bitsPerKey bits for each key.
+func newBloomFilter(hashes []uint64, bitsPerKey int) *bloomFilter {
+	// k = ln(2) * bitsPerKey minimizes the false positive rate.
+	k := uint8(float64(bitsPerKey) * 0.69)
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+
+	// Use at least 64 bits to keep a low false positive rate for small files.
+	nbits := len(hashes) * bitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	f := &bloomFilter{bits: make([]byte, (nbits+7)/8), k: k}
+	nbits = len(f.bits) * 8
+
+	for _, h := range hashes {
+		// Double hashing : the k probes are derived from the two halves of the hash.
+		h1, h2 := uint32(h), uint32(h>>32)
+		for i := uint8(0); i < k; i++ {
+			pos := (h1 + uint32(i)*h2) % uint32(nbits)
+			f.bits[pos/8] |= 1 << (pos % 8)
+		}
+	}
+	return f
+}
+
+// mayContain returns false if the key is surely not in the file.
+func (f *bloomFilter) mayContain(key string) bool {
+	h := bloomHash(key)
+	h1, h2 := uint32(h), uint32(h>>32)
+	nbits := uint32(len(f.bits) * 8)
+	for i := uint8(0); i < f.k; i++ {
+		pos := (h1 + uint32(i)*h2) % nbits
+		if f.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) encode() []byte {
+	return append(append([]byte{}, f.bits...), f.k)
+}
+
+// decodeBloomFilter returns nil if the block holds no filter.
+func decodeBloomFilter(data []byte) *bloomFilter {
+	if len(data) < 2 {
+		return nil
+	}
+	return &bloomFilter{bits: data[:len(data)-1], k: data[len(data)-1]}
+}
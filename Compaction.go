@@ -0,0 +1,480 @@
+package main
+
+// The compaction strategy of a store picks the SST files merged by each compaction, and the level of the files written (see
+// CompactionStrategy below). It is chosen when the store is opened (see Options.go), the default one is the leveled compaction.
+// The strategy can be changed between two runs of the store, the files written by one strategy are read by the other.
+// The compactions run in the background while the store is used (see CompactionScheduler.go), a file merged by a compaction in progress
+// is never picked by another one.
+
+// The leveled compaction organizes the SST files in levels, as in LevelDB :
+
+// L0 holds the files flushed from the main memory, their key ranges overlap, a lookup searches them from the newest to the oldest.
+// The deeper levels (L1 ... L(maxLevels-1)) hold sorted runs : the files of a level don't overlap, a lookup reads a single file of the
+// level. Each level has a size target, ten times the one of the level above it (levelBaseSize for L1).
+
+// A compaction is needed when L0 holds l0CompactionTrigger files or more, or when a deeper level is over its target. The level that
+// is the most over its target is compacted first : one file of the level is picked (the oldest one for L0, the files of the other
+// levels in turn), then it is merged with the files of the next level that overlap its key range. The merged records are written to
+// new files of the next level (of maxFileSize bytes at most), that replace the input files in the MANIFEST.
+
+// The records of a key in a level are always older than the ones of the levels above it, so a lookup can stop at the first record
+// found. A compaction keeps only the newest record of each key (and the older ones still read by a snapshot, see Snapshot.go), and
+// drops a deletion when no file older than the inputs may still hold the key (the deletion has nothing left to hide). An expired
+// value is merged as a deletion of its key : it is dropped with the older records of the key, or only its value when an older file
+// (or a snapshot) may still read the key. The deletion keeps the expiry of the value, it reads as a missing key. The merge operands
+// are folded into a value when the records under them are merged as well (see Merge.go).
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// CompactionStrategy : Picks the next compaction of a store. A strategy can keep the state of the compactions of a store between two
+// picks, it must not be shared between stores.
+type CompactionStrategy interface {
+	// PickCompaction returns the next compaction, or nil when none is needed. The live SST files are given from the oldest to the
+	// newest (see fileLess), the files merged by the compactions in progress are in compacting and must not be picked.
+	PickCompaction(files []fileMeta, compacting map[uint64]bool) *compaction
+}
+
+// compaction : The SST files merged by a compaction, and the level of the files written.
+type compaction struct {
+	// From the newest to the oldest.
+	inputs      []fileMeta
+	outputLevel int
+	// Maximum size of a file written, 0 writes all the records to a single file.
+	maxOutputSize int64
+	// The live snapshots when the compaction was picked, the older records they read are kept (see Snapshot.go).
+	snapshots []uint64
+}
+
+// levelFiles returns the files of the level, from the oldest to the newest for L0, sorted by key for the other levels.
+func levelFiles(files []fileMeta, level int) []fileMeta {
+	var res []fileMeta
+	for _, f := range files {
+		if f.Level == level {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+func levelSize(files []fileMeta) int64 {
+	var size int64
+	for _, f := range files {
+		size += f.Size
+	}
+	return size
+}
+
+// maxBytesForLevel returns the size target of a level (L1 or deeper).
+func maxBytesForLevel(level int) int64 {
+	size := levelBaseSize
+	for i := 1; i < level; i++ {
+		size *= levelSizeMultiplier
+	}
+	return size
+}
+
+// overlaps checks if the key range of the file meets [smallest, largest].
+func overlaps(f fileMeta, smallest, largest string) bool {
+	return f.Smallest <= largest && smallest <= f.Largest
+}
+
+// LeveledCompaction : The default compaction strategy, described above.
+type LeveledCompaction struct {
+	// For each level, the largest key of the last file compacted.
+	compactPointer [maxLevels]string
+}
+
+func NewLeveledCompaction() *LeveledCompaction {
+	return &LeveledCompaction{}
+}
+
+// PickCompaction returns a compaction of the level that is the most over its target, or nil when every level is within its target.
+// When the files of that level are all being compacted, the next level the most over its target is picked.
+func (lc *LeveledCompaction) PickCompaction(files []fileMeta, compacting map[uint64]bool) *compaction {
+	type candidate struct {
+		level int
+		score float64
+	}
+	var levels []candidate
+	// The last level has no target.
+	for l := 0; l < maxLevels-1; l++ {
+		var score float64
+		if l == 0 {
+			score = float64(len(levelFiles(files, l))) / float64(l0CompactionTrigger)
+		} else {
+			score = float64(levelSize(levelFiles(files, l))) / float64(maxBytesForLevel(l))
+		}
+		if score >= 1 {
+			levels = append(levels, candidate{l, score})
+		}
+	}
+	sort.SliceStable(levels, func(i, j int) bool { return levels[i].score > levels[j].score })
+
+	for _, l := range levels {
+		if c := lc.pickFile(files, l.level, compacting); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// pickFile returns the compaction of a file of the level, or nil if the files that could be picked are being compacted.
+func (lc *LeveledCompaction) pickFile(files []fileMeta, level int, compacting map[uint64]bool) *compaction {
+	candidates := levelFiles(files, level)
+	if level == 0 {
+		// Only the oldest file of L0 : the newer files that overlap it stay above it.
+		candidates = candidates[:1]
+	} else {
+		// The files of the level are compacted in turn, starting after the last key compacted.
+		start := 0
+		for start < len(candidates) && candidates[start].Smallest <= lc.compactPointer[level] {
+			start++
+		}
+		candidates = append(candidates[start:], candidates[:start]...)
+	}
+
+	for _, file := range candidates {
+		if compacting[file.Num] {
+			continue
+		}
+		c := &compaction{inputs: []fileMeta{file}, outputLevel: level + 1, maxOutputSize: maxFileSize}
+		busy := false
+		for _, f := range levelFiles(files, level+1) {
+			if overlaps(f, file.Smallest, file.Largest) {
+				c.inputs = append(c.inputs, f)
+				busy = busy || compacting[f.Num]
+			}
+		}
+		// The files written to the next level would overlap the ones of the other compaction.
+		if busy {
+			continue
+		}
+		if level > 0 {
+			lc.compactPointer[level] = file.Largest
+		}
+		return c
+	}
+	return nil
+}
+
+// pickCompaction returns the next compaction picked by the strategy of the store, its input files are marked as being compacted
+// until compact returns.
+func (m *mySSTManager) pickCompaction() *compaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.strategy.PickCompaction(m.metas(), m.compacting)
+	if c == nil {
+		return nil
+	}
+	for _, f := range c.inputs {
+		m.compacting[f.Num] = true
+	}
+	// The snapshots taken later read none of the older records of the inputs.
+	c.snapshots = m.snapshots.list()
+	return c
+}
+
+// compact merges the input files of the compaction into new files of the output level, that replace them in the MANIFEST.
+// The compaction is canceled (and the files written deleted) once stop is closed.
+func (m *mySSTManager) compact(c *compaction, stop <-chan struct{}) error {
+	defer func() {
+		m.mu.Lock()
+		for _, f := range c.inputs {
+			delete(m.compacting, f.Num)
+		}
+		m.mu.Unlock()
+	}()
+
+	// A single file that overlaps no file of the output level only changes level.
+	if len(c.inputs) == 1 {
+		moved := c.inputs[0]
+		moved.Level = c.outputLevel
+		return m.logAndApply(versionEdit{Added: []fileMeta{moved}, Deleted: []uint64{moved.Num}})
+	}
+
+	// Open the input files.
+	iters := make([]*sstIterator, len(c.inputs))
+	out := &compactionOutput{m: m, level: c.outputLevel, maxSize: c.maxOutputSize}
+	for i, f := range c.inputs {
+		file, err := os.Open(sstFileName(directory, f.Num))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		table, err := openSSTTable(file)
+		if err != nil {
+			return err
+		}
+		// Never write the records of a damaged file to the merged ones.
+		if err := table.verify(); err != nil {
+			return err
+		}
+		iters[i] = table.newIterator()
+		out.maxSeq = max(out.maxSeq, f.MaxSeq)
+	}
+
+	// The files older than the inputs, whose key range may hold the key of a deletion. The files written from them by the other
+	// compactions hold the same keys, the deletions they keep are still kept.
+	older := m.olderFiles(c.inputs)
+	keepDeletion := func(key string) bool {
+		for _, f := range older {
+			if overlaps(f, key, key) {
+				return true
+			}
+		}
+		return false
+	}
+
+	add := func(record FileRecord) error {
+		select {
+		case <-stop:
+			return errCompactionCanceled
+		default:
+		}
+		return out.add(record)
+	}
+	stats, err := mergeInputs(iters, c.snapshots, time.Now().UnixNano(), m.mergeOp, keepDeletion, add)
+	if err != nil {
+		out.abort()
+		return err
+	}
+	if err := out.finish(); err != nil {
+		out.abort()
+		return err
+	}
+	if err := syncDir(directory); err != nil {
+		out.abort()
+		return err
+	}
+
+	// From now on the new files replace the input files.
+	var opened []*sstFile
+	for _, meta := range out.files {
+		f, err := m.openFile(meta)
+		if err != nil {
+			out.abort()
+			return err
+		}
+		opened = append(opened, f)
+	}
+	edit := versionEdit{Added: out.files}
+	for _, f := range c.inputs {
+		edit.Deleted = append(edit.Deleted, f.Num)
+	}
+	if err := m.logAndApply(edit, opened...); err != nil {
+		out.abort()
+		return err
+	}
+
+	// The input files are deleted by logAndApply, once the iterators reading them are closed.
+	fmt.Printf("Compacted %d SST files to L%d : %d records written, %d duplicates and %d deletions dropped, %d values expired, %d records merged\n",
+		len(c.inputs), c.outputLevel, stats.written, stats.duplicates, stats.deletions, stats.expired, stats.merged)
+	return nil
+}
+
+// olderFiles returns the live files older than the inputs (see fileLess) that are not inputs.
+func (m *mySSTManager) olderFiles(inputs []fileMeta) []fileMeta {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	isInput := make(map[uint64]bool)
+	for _, f := range inputs {
+		isInput[f.Num] = true
+	}
+	var older []fileMeta
+	for _, f := range m.files {
+		if !isInput[f.Num] && fileLess(f.fileMeta, inputs[0]) {
+			older = append(older, f.fileMeta)
+		}
+	}
+	return older
+}
+
+// mergeStats : The counters of a merge.
+type mergeStats struct {
+	// Records added.
+	written int
+	// Older records of a key dropped, no snapshot reads them.
+	duplicates int
+	// Deletions dropped, no older file may hold their key.
+	deletions int
+	// Values expired, merged as deletions.
+	expired int
+	// Older records of a key folded into the merge operands above them.
+	merged int
+}
+
+// mergeInputs calls add for the newest record of every key of the inputs, and for the older records read by the snapshots, sorted by
+// key. The inputs are given from the newest to the oldest, and the records of the same key in an input from the newest to the oldest.
+// The merge operands are folded by op with the records under them when it can be done (see keptRecords). A deletion is dropped when
+// keepDeletion returns false for its key and no snapshot reads the records before it. A value expired at now is merged as a deletion.
+func mergeInputs(iters []*sstIterator, snapshots []uint64, now int64, op MergeOperator, keepDeletion func(key string) bool, add func(FileRecord) error) (mergeStats, error) {
+	var stats mergeStats
+	heads := make([]FileRecord, len(iters))
+	valid := make([]bool, len(iters))
+	next := func(i int) error {
+		record, err := iters[i].next()
+		if err == io.EOF {
+			valid[i] = false
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		heads[i], valid[i] = record, true
+		return nil
+	}
+	for i := range iters {
+		if err := next(i); err != nil {
+			return stats, err
+		}
+	}
+
+	// No older record of the key may exist when its deletions can be dropped.
+	bottom := func(key string) bool { return !keepDeletion(key) }
+	// The records of the current key, from the newest to the oldest.
+	var records []FileRecord
+	flush := func() error {
+		kept, folded := keptRecords(records, snapshots, now, op, bottom)
+		stats.duplicates += len(records) - len(kept) - folded
+		stats.merged += folded
+		for _, record := range kept {
+			if record.expired(now) {
+				// The deletion keeps the expiry, the key is still read as missing rather than deleted.
+				record = FileRecord{Operation: Del, Key: record.Key, Seq: record.Seq, Expiry: record.Expiry}
+				stats.expired++
+			}
+			if record.Operation == Del && !snapshotBefore(record.Seq, snapshots) && !keepDeletion(record.Key) {
+				stats.deletions++
+				continue
+			}
+			if err := add(record); err != nil {
+				return err
+			}
+			stats.written++
+		}
+		records = records[:0]
+		return nil
+	}
+	for {
+		// The smallest key, from the newest input that holds it.
+		first := -1
+		for i := range iters {
+			if valid[i] && (first == -1 || heads[i].Key < heads[first].Key) {
+				first = i
+			}
+		}
+		if first == -1 {
+			if len(records) > 0 {
+				return stats, flush()
+			}
+			return stats, nil
+		}
+
+		record := heads[first]
+		if len(records) > 0 && record.Key != records[0].Key {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+		records = append(records, record)
+
+		if err := next(first); err != nil {
+			return stats, err
+		}
+	}
+}
+
+// compactionOutput writes the records of a compaction to new SST files of maxSize bytes at most.
+type compactionOutput struct {
+	m       *mySSTManager
+	level   int
+	maxSeq  uint64
+	maxSize int64
+
+	// The file being written, and its number.
+	file *os.File
+	num  uint64
+	w    *sstWriter
+	// The files written.
+	files []fileMeta
+}
+
+func (o *compactionOutput) add(record FileRecord) error {
+	// A new file is started once the current one is full, but never between two records of a key : the files of a level must not
+	// overlap.
+	if o.w != nil && o.maxSize > 0 && int64(o.w.offset) >= o.maxSize && record.Key != o.w.lastKey {
+		if err := o.finish(); err != nil {
+			return err
+		}
+	}
+
+	if o.w == nil {
+		o.num = o.m.manifest.newFileNumber()
+		file, err := os.OpenFile(fmt.Sprintf("%s/SST%d%s", directory, o.num, ext), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		o.file = file
+		if o.w, err = newSSTWriter(file, o.m.bitsPerKey); err != nil {
+			return err
+		}
+	}
+	return o.w.add(record)
+}
+
+// finish syncs the file being written and gives it its final name.
+func (o *compactionOutput) finish() error {
+	if o.w == nil {
+		return nil
+	}
+	if err := o.w.finish(); err != nil {
+		return err
+	}
+	// The input files are deleted once the new ones are recorded, the new ones must be on the disk first.
+	if err := o.file.Sync(); err != nil {
+		return err
+	}
+	o.file.Close()
+	if err := os.Rename(o.file.Name(), sstFileName(directory, o.num)); err != nil {
+		return err
+	}
+
+	meta := o.w.fileMeta(o.num, o.maxSeq)
+	meta.Level = o.level
+	o.files = append(o.files, meta)
+	o.w = nil
+	return nil
+}
+
+// abort deletes the files written by a compaction that failed.
+func (o *compactionOutput) abort() {
+	if o.w != nil {
+		o.file.Close()
+		os.Remove(o.file.Name())
+	}
+	for _, f := range o.files {
+		os.Remove(sstFileName(directory, f.Num))
+	}
+}
+
+// fileLess sorts the files from the oldest to the newest : the deepest level first, L0 last. The files of L0 are sorted by sequence
+// number, the ones of the other levels by key.
+func fileLess(a, b fileMeta) bool {
+	if a.Level != b.Level {
+		return a.Level > b.Level
+	}
+	if a.Level > 0 && a.Smallest != b.Smallest {
+		return a.Smallest < b.Smallest
+	}
+	if a.MaxSeq != b.MaxSeq {
+		return a.MaxSeq < b.MaxSeq
+	}
+	return a.Num < b.Num
+}
@@ -0,0 +1,94 @@
+package main
+
+// The compactions run in the background, while the store is read and written. A scheduler goroutine checks if a compaction is needed
+// (as decided by the compaction strategy, from the number of SST files and the size of the levels) when the store starts, after each
+// flush and each time a compaction is done, and starts the compactions needed, at most maxCompactions at the same time.
+
+// Stop cancels the compactions in progress : they stop before writing the next record, delete the files they wrote, and leave their
+// input files as they are.
+
+// A compaction that fails is not retried until the next flush (the same files would be picked again right away).
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var errCompactionCanceled = errors.New("compaction canceled")
+
+// startCompactions starts the background compactions, 0 compactions at the same time disables them.
+func (m *mySSTManager) startCompactions() {
+	if m.maxCompactions <= 0 || m.stop != nil {
+		return
+	}
+	m.wake = make(chan struct{}, 1)
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.scheduleCompactions(m.wake, m.stop)
+	m.wakeCompactions()
+}
+
+// wakeCompactions asks the scheduler to check if a compaction is needed.
+func (m *mySSTManager) wakeCompactions() {
+	if m.wake == nil {
+		return
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+		// The scheduler is already woken.
+	}
+}
+
+// stopCompactions cancels the background compactions, and returns once they are all done.
+func (m *mySSTManager) stopCompactions() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+	m.stop = nil
+	m.wake = nil
+}
+
+func (m *mySSTManager) scheduleCompactions(wake <-chan struct{}, stop <-chan struct{}) {
+	defer close(m.done)
+
+	var wg sync.WaitGroup
+	// Each compaction sends its result once done, there is room for all of them.
+	finished := make(chan error, m.maxCompactions)
+	running := 0
+	paused := false
+
+	for {
+		// Start the compactions needed while there is room for them.
+		for !paused && running < m.maxCompactions {
+			c := m.pickCompaction()
+			if c == nil {
+				break
+			}
+			fmt.Printf("Compacting %d SST files to L%d\n", len(c.inputs), c.outputLevel)
+			running++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				finished <- m.compact(c, stop)
+			}()
+		}
+
+		select {
+		case <-wake:
+			paused = false
+		case err := <-finished:
+			running--
+			if err != nil {
+				fmt.Println("Error in a background compaction:", err)
+				paused = true
+			}
+		case <-stop:
+			wg.Wait()
+			return
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chdirTemp runs the test in a temporary directory, where the store creates its directories.
+func chdirTemp(t *testing.T) {
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// addTestFile writes the records to a new SST file of L0, and records it in the MANIFEST.
+func addTestFile(t *testing.T, m *mySSTManager, records []FileRecord) fileMeta {
+	sortRecords(records)
+	meta := writeTestSSTFile(t, directory, m.manifest.newFileNumber(), records)
+	m.manifest.mu.Lock()
+	meta.MaxSeq = m.manifest.lastSeq + 1
+	m.manifest.mu.Unlock()
+	assert.NoError(t, m.logAndApply(versionEdit{Added: []fileMeta{meta}, LastSeq: meta.MaxSeq}))
+	return meta
+}
+
+// checkLevels checks that the files of the levels below L0 don't overlap.
+func checkLevels(t *testing.T, m *mySSTManager) {
+	for level := 1; level < maxLevels; level++ {
+		files := levelFiles(m.metas(), level)
+		for i := 1; i < len(files); i++ {
+			assert.Less(t, files[i-1].Largest, files[i].Smallest)
+		}
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	chdirTemp(t)
+	m, err := NewSSTManager(defLoad, treshold)
+	assert.NoError(t, err)
+	defer m.manifest.Close()
+
+	// Each flush overwrites half of the keys of the previous one, and deletes its first key.
+	n := 2 * l0CompactionTrigger
+	for i := 0; i < n; i++ {
+		records := []FileRecord{{Operation: "del", Key: fmt.Sprintf("Key_%04d", i*50)}}
+		for k := i*50 + 1; k < i*50+100; k++ {
+			records = append(records, FileRecord{Operation: "set", Key: fmt.Sprintf("Key_%04d", k), Value: fmt.Sprintf("Value_%d", i)})
+		}
+		addTestFile(t, m, records)
+	}
+
+	// The oldest file of L0 is compacted first.
+	c := m.strategy.PickCompaction(m.metas(), m.compacting)
+	assert.NotNil(t, c)
+	assert.Equal(t, 1, c.outputLevel)
+	assert.Equal(t, levelFiles(m.metas(), 0)[0], c.inputs[0])
+
+	for c := m.pickCompaction(); c != nil; c = m.pickCompaction() {
+		assert.NoError(t, m.compact(c, nil))
+		checkLevels(t, m)
+	}
+	assert.Less(t, len(levelFiles(m.metas(), 0)), l0CompactionTrigger)
+	assert.NotEmpty(t, levelFiles(m.metas(), 1))
+
+	// The newest record of each key is found, whatever the level it is in.
+	m.refresh()
+	assert.NoError(t, m.LoadALL())
+	for k := 0; k < (n-1)*50+100; k++ {
+		key := fmt.Sprintf("Key_%04d", k)
+		i := min(k/50, n-1)
+		val, err := m.Search(key)
+		if k == i*50 {
+			// The deletion is dropped once merged with the older records of the key.
+			assert.Error(t, err, key)
+			assert.Contains(t, []string{"Key Deleted", "Key Not Found"}, err.Error(), key)
+		} else {
+			assert.NoError(t, err, key)
+			assert.Equal(t, fmt.Sprintf("Value_%d", i), val, key)
+		}
+	}
+
+	// The MANIFEST holds the levels.
+	files := m.metas()
+	assert.NoError(t, m.manifest.Close())
+	mf, err := openManifest(directory, nil)
+	assert.NoError(t, err)
+	defer mf.Close()
+	assert.Equal(t, files, mf.sortedFiles())
+}
+
+func TestCompactionOutputFiles(t *testing.T) {
+	chdirTemp(t)
+	m, err := NewSSTManager(defLoad, treshold)
+	assert.NoError(t, err)
+	defer m.manifest.Close()
+
+	// Two files holding the same keys, with values large enough to fill several output files.
+	value := strings.Repeat("v", 1000)
+	var records []FileRecord
+	for j := 0; j < 5000; j++ {
+		records = append(records, FileRecord{Operation: "set", Key: fmt.Sprintf("Key_%04d", j), Value: "old" + value})
+	}
+	old := addTestFile(t, m, records)
+	for j := range records {
+		records[j].Value = "new" + value
+	}
+	newer := addTestFile(t, m, records)
+
+	assert.NoError(t, m.compact(&compaction{inputs: []fileMeta{newer, old}, outputLevel: 1, maxOutputSize: maxFileSize}, nil))
+	files := levelFiles(m.metas(), 1)
+	assert.Greater(t, len(files), 1)
+	assert.Empty(t, levelFiles(m.metas(), 0))
+	checkLevels(t, m)
+
+	// Each file holds the newest record of its keys.
+	for _, f := range files {
+		all := readTestSSTFile(t, f.Num)
+		for i := range all {
+			if i > 0 {
+				assert.Less(t, all[i-1].Key, all[i].Key)
+			}
+			assert.Equal(t, "new"+value, all[i].Value)
+		}
+		assert.Equal(t, f.Smallest, all[0].Key)
+		assert.Equal(t, f.Largest, all[len(all)-1].Key)
+	}
+
+	// The input files are deleted.
+	_, err = os.Stat(sstFileName(directory, old.Num))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSizeTieredPick(t *testing.T) {
+	st := NewSizeTieredCompaction()
+	var files []fileMeta
+	add := func(sizes ...int64) {
+		for _, size := range sizes {
+			n := uint64(len(files))
+			files = append(files, fileMeta{Num: n, Size: size, MaxSeq: n + 1})
+		}
+	}
+
+	// Not enough files of the same size.
+	add(1000, 100, 100, 100)
+	assert.Nil(t, st.PickCompaction(files, nil))
+
+	// The bucket of the small files is merged first, the newest file first.
+	add(110, 10000, 10000, 10000, 10000)
+	c := st.PickCompaction(files, nil)
+	assert.NotNil(t, c)
+	assert.Equal(t, 0, c.outputLevel)
+	assert.Equal(t, []fileMeta{files[4], files[3], files[2], files[1]}, c.inputs)
+
+	// A file of another size between two runs splits them.
+	files = nil
+	add(100, 100, 10000, 100, 100)
+	assert.Nil(t, st.PickCompaction(files, nil))
+}
+
+func TestSizeTieredCompaction(t *testing.T) {
+	chdirTemp(t)
+	m, err := NewSSTManager(defLoad, treshold)
+	assert.NoError(t, err)
+	defer m.manifest.Close()
+	m.strategy = NewSizeTieredCompaction()
+
+	// Every flush overwrites the same keys.
+	for i := 0; i < 16; i++ {
+		var records []FileRecord
+		for k := 0; k < 100; k++ {
+			records = append(records, FileRecord{Operation: "set", Key: fmt.Sprintf("Key_%03d", k), Value: fmt.Sprintf("Value_%d", i)})
+		}
+		addTestFile(t, m, records)
+	}
+
+	// The files have the same size, they are merged at once.
+	for c := m.pickCompaction(); c != nil; c = m.pickCompaction() {
+		assert.NoError(t, m.compact(c, nil))
+	}
+	assert.Equal(t, 1, len(m.files))
+	assert.Equal(t, 0, m.files[0].Level)
+
+	m.refresh()
+	assert.NoError(t, m.LoadALL())
+	for k := 0; k < 100; k++ {
+		val, err := m.Search(fmt.Sprintf("Key_%03d", k))
+		assert.NoError(t, err)
+		assert.Equal(t, "Value_15", val)
+	}
+}
+
+// waitCompactions waits until no compaction is needed nor in progress.
+func waitCompactions(m *mySSTManager) {
+	for {
+		m.mu.Lock()
+		c := m.strategy.PickCompaction(m.metas(), m.compacting)
+		busy := len(m.compacting)
+		m.mu.Unlock()
+		if c == nil && busy == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBackgroundCompactions(t *testing.T) {
+	chdirTemp(t)
+	m, err := NewSSTManager(defLoad, treshold)
+	assert.NoError(t, err)
+	defer m.manifest.Close()
+	m.maxCompactions = 2
+	m.startCompactions()
+
+	// The keys are searched while the files are compacted.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if val, err := m.Search("Key_000"); err == nil {
+				assert.Equal(t, "Value", val)
+			}
+		}
+	}()
+
+	for i := 0; i < 3*l0CompactionTrigger; i++ {
+		var records []FileRecord
+		for k := 0; k < 100; k++ {
+			records = append(records, FileRecord{Operation: "set", Key: fmt.Sprintf("Key_%03d", k*(i+1)), Value: "Value"})
+		}
+		addTestFile(t, m, records)
+		m.wakeCompactions()
+	}
+	waitCompactions(m)
+	close(stop)
+	wg.Wait()
+	m.stopCompactions()
+
+	assert.Less(t, len(levelFiles(m.metas(), 0)), l0CompactionTrigger)
+	checkLevels(t, m)
+	for k := 0; k < 100; k++ {
+		val, err := m.Search(fmt.Sprintf("Key_%03d", k))
+		assert.NoError(t, err)
+		assert.Equal(t, "Value", val)
+	}
+}
+
+func TestCancelCompaction(t *testing.T) {
+	chdirTemp(t)
+	m, err := NewSSTManager(defLoad, treshold)
+	assert.NoError(t, err)
+	defer m.manifest.Close()
+
+	var records []FileRecord
+	for k := 0; k < 1000; k++ {
+		records = append(records, FileRecord{Operation: "set", Key: fmt.Sprintf("Key_%04d", k), Value: strings.Repeat("v", 1000)})
+	}
+	old := addTestFile(t, m, records)
+	newer := addTestFile(t, m, records)
+
+	// The compaction is canceled before writing any record.
+	stop := make(chan struct{})
+	close(stop)
+	c := &compaction{inputs: []fileMeta{newer, old}, outputLevel: 1, maxOutputSize: maxFileSize}
+	assert.ErrorIs(t, m.compact(c, stop), errCompactionCanceled)
+
+	// Its input files are still live, and the files it wrote are deleted.
+	assert.Equal(t, []fileMeta{old, newer}, m.metas())
+	found, err := CheckAndClean()
+	assert.NoError(t, err)
+	assert.Empty(t, m.manifest.orphans(found))
+	assert.Equal(t, len(m.files), len(found))
+}
+
+// readTestSSTFile returns the records of an SST file.
+func readTestSSTFile(t *testing.T, num uint64) []FileRecord {
+	file, err := os.Open(sstFileName(directory, num))
+	assert.NoError(t, err)
+	defer file.Close()
+	table, err := openSSTTable(file)
+	assert.NoError(t, err)
+	var all []FileRecord
+	it := table.newIterator()
+	for r, err := it.next(); err == nil; r, err = it.next() {
+		all = append(all, r)
+	}
+	return all
+}
+
+func TestCompactionDropsDuplicatesAndDeletions(t *testing.T) {
+	chdirTemp(t)
+	m, err := NewSSTManager(defLoad, treshold)
+	assert.NoError(t, err)
+	defer m.manifest.Close()
+
+	// An L2 file holds Key_00 ... Key_09, it is older than the L1 file holding Key_00 ... Key_99.
+	var records []FileRecord
+	for k := 0; k < 10; k++ {
+		records = append(records, FileRecord{Operation: "set", Key: fmt.Sprintf("Key_%02d", k), Value: "Value_0"})
+	}
+	deep := addTestFile(t, m, records)
+	deep.Level = 2
+	assert.NoError(t, m.logAndApply(versionEdit{Added: []fileMeta{deep}, Deleted: []uint64{deep.Num}}))
+
+	records = nil
+	for k := 0; k < 100; k++ {
+		records = append(records, FileRecord{Operation: "set", Key: fmt.Sprintf("Key_%02d", k), Value: "Value_1"})
+	}
+	old := addTestFile(t, m, records)
+	old.Level = 1
+	assert.NoError(t, m.logAndApply(versionEdit{Added: []fileMeta{old}, Deleted: []uint64{old.Num}}))
+
+	// The newest file deletes Key_00 ... Key_49.
+	for k := 0; k < 50; k++ {
+		records[k] = FileRecord{Operation: "del", Key: fmt.Sprintf("Key_%02d", k)}
+	}
+	newer := addTestFile(t, m, records)
+
+	c := &compaction{inputs: []fileMeta{newer, old}, outputLevel: 1, maxOutputSize: maxFileSize}
+	assert.Equal(t, []fileMeta{deep}, m.olderFiles(c.inputs))
+
+	// The counters of the merge.
+	var iters []*sstIterator
+	for _, f := range c.inputs {
+		file, err := os.Open(sstFileName(directory, f.Num))
+		assert.NoError(t, err)
+		defer file.Close()
+		table, err := openSSTTable(file)
+		assert.NoError(t, err)
+		iters = append(iters, table.newIterator())
+	}
+	keepDeletion := func(key string) bool { return overlaps(deep, key, key) }
+	stats, err := mergeInputs(iters, nil, 0, nil, keepDeletion, func(FileRecord) error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, mergeStats{written: 60, duplicates: 100, deletions: 40}, stats)
+
+	// The deletions of the keys of the L2 file are kept, the other ones are dropped.
+	assert.NoError(t, m.compact(c, nil))
+	files := levelFiles(m.metas(), 1)
+	assert.Equal(t, 1, len(files))
+	all := readTestSSTFile(t, files[0].Num)
+	assert.Equal(t, 60, len(all))
+	for _, r := range all[:10] {
+		assert.Equal(t, Del, r.Operation)
+	}
+	for _, r := range all[10:] {
+		assert.Equal(t, Put, r.Operation)
+		assert.Equal(t, "Value_1", r.Value)
+	}
+	assert.Equal(t, "Key_50", all[10].Key)
+
+	_, err = m.Search("Key_05")
+	assert.EqualError(t, err, "Key Deleted")
+	_, err = m.Search("Key_20")
+	assert.EqualError(t, err, "Key Not Found")
+}
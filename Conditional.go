@@ -0,0 +1,70 @@
+package main
+
+// The conditional writes compare the newest value of a key before writing it. The comparison is done by the commit leader (see
+// GroupCommit.go), once every write before it is applied and before any later write, so no write of the key comes in between :
+// of two clients racing on the same key, only one sees the value it expects.
+
+import (
+	"errors"
+)
+
+// ErrKeyNotFound : The key has no value, it was never written or its value expired.
+var ErrKeyNotFound = errors.New("Key Not Found")
+
+// ErrKeyDeleted : The newest record of the key is a deletion.
+var ErrKeyDeleted = errors.New("Key Deleted")
+
+// ErrKeyExists : SetIfAbsent found a value for the key.
+var ErrKeyExists = errors.New("Key Exists")
+
+// ErrValueMismatch : The key doesn't have the value expected by CompareAndSwap or DeleteIfEquals (or has none).
+var ErrValueMismatch = errors.New("Value Mismatch")
+
+// CompareAndSwap writes val as the value of the key if its value is expected, else it returns ErrValueMismatch.
+func (kv *MyKvStore) CompareAndSwap(key string, expected string, val string) error {
+	defer kv.CheckIfFlush()
+	return kv.memDB.SetIf(key, val, func() error {
+		return kv.expectValue(key, expected)
+	})
+}
+
+// SetIfAbsent writes the value of the key if the key has none (a deleted or expired key has none), else it returns ErrKeyExists.
+func (kv *MyKvStore) SetIfAbsent(key string, val string) error {
+	defer kv.CheckIfFlush()
+	return kv.memDB.SetIf(key, val, func() error {
+		_, found, err := kv.lookup(key)
+		if err == nil && found {
+			return ErrKeyExists
+		}
+		return err
+	})
+}
+
+// DeleteIfEquals deletes the key if its value is expected, else it returns ErrValueMismatch.
+func (kv *MyKvStore) DeleteIfEquals(key string, expected string) error {
+	defer kv.CheckIfFlush()
+	return kv.memDB.DelIf(key, func() error {
+		return kv.expectValue(key, expected)
+	})
+}
+
+// expectValue returns ErrValueMismatch if the newest value of the key is not expected.
+func (kv *MyKvStore) expectValue(key string, expected string) error {
+	val, found, err := kv.lookup(key)
+	if err == nil && (!found || val != expected) {
+		return ErrValueMismatch
+	}
+	return err
+}
+
+// lookup returns the newest value of the key, the second value is false if the key has none.
+func (kv *MyKvStore) lookup(key string) (string, bool, error) {
+	val, err := kv.Get(key)
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrKeyDeleted) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return val, true, nil
+}
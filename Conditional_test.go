@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+
+	// SetIfAbsent writes a missing, deleted or expired key only.
+	assert.NoError(t, kv.SetIfAbsent("a", "1"))
+	assert.ErrorIs(t, kv.SetIfAbsent("a", "2"), ErrKeyExists)
+	_, err := kv.Del("a")
+	assert.NoError(t, err)
+	assert.NoError(t, kv.SetIfAbsent("a", "3"))
+	assert.NoError(t, kv.SetWithTTL("b", "1", -time.Second))
+	assert.NoError(t, kv.SetIfAbsent("b", "2"))
+	v, err := kv.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "3", v)
+
+	// CompareAndSwap compares the newest value.
+	assert.ErrorIs(t, kv.CompareAndSwap("a", "1", "4"), ErrValueMismatch)
+	assert.NoError(t, kv.CompareAndSwap("a", "3", "4"))
+	assert.ErrorIs(t, kv.CompareAndSwap("missing", "", "1"), ErrValueMismatch)
+	v, err = kv.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "4", v)
+
+	// DeleteIfEquals as well.
+	assert.ErrorIs(t, kv.DeleteIfEquals("a", "3"), ErrValueMismatch)
+	assert.NoError(t, kv.DeleteIfEquals("a", "4"))
+	assert.ErrorIs(t, kv.DeleteIfEquals("a", "4"), ErrValueMismatch)
+	_, err = kv.Get("a")
+	assert.ErrorIs(t, err, ErrKeyDeleted)
+	_, err = kv.Get("missing")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestCompareAndSwapCounter(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+	assert.NoError(t, kv.Set("counter", "0"))
+
+	// Concurrent increments retried when the value changed : none is lost.
+	const workers, increments = 4, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				for {
+					v, err := kv.Get("counter")
+					assert.NoError(t, err)
+					n, _ := strconv.Atoi(v)
+					err = kv.CompareAndSwap("counter", v, strconv.Itoa(n+1))
+					if err != ErrValueMismatch {
+						assert.NoError(t, err)
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := kv.Get("counter")
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(workers*increments), v)
+}
+
+func TestHTTPConditionalWrites(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+	api := &HTTP_API_DB{db: kv}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cas", api.HandleCAS)
+	mux.HandleFunc("/setifabsent", api.HandleSetIfAbsent)
+	mux.HandleFunc("/delifequals", api.HandleDeleteIfEquals)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	post := func(path string) int {
+		resp, err := http.Post(server.URL+path, "", nil)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusNoContent, post("/setifabsent?key=a&value=1"))
+	assert.Equal(t, http.StatusConflict, post("/setifabsent?key=a&value=2"))
+	assert.Equal(t, http.StatusPreconditionFailed, post("/cas?key=a&expected=2&value=3"))
+	assert.Equal(t, http.StatusNoContent, post("/cas?key=a&expected=1&value=3"))
+	assert.Equal(t, http.StatusBadRequest, post("/cas?key=a&expected=3"))
+	assert.Equal(t, http.StatusPreconditionFailed, post("/delifequals?key=a&expected=1"))
+	assert.Equal(t, http.StatusNoContent, post("/delifequals?key=a&expected=3"))
+	_, err := kv.Get("a")
+	assert.Error(t, err)
+}
@@ -0,0 +1,168 @@
+package main
+
+// Group commit : The writes are queued, the writer at the head of the queue (the leader) takes all the queued writes, appends them
+// to the WAL with a single write and a single sync, applies them to the main memory in order, and then releases every writer of the
+// group with its own result. The other writers (the followers) only wait, the next leader is the writer at the head of the queue
+// once the group is done.
+
+// The group commit is the single writer path of the store : the main memory is only written by the leader, so the writes are
+// applied one at a time, in the order of the WAL. A write that depends on the current records (a deletion that returns the value
+// deleted) is checked by the leader, in a group of its own, so that no other write comes in between.
+
+// The leader gives each record written the next sequence number (see Snapshot.go), and once the whole group is applied makes it
+// visible to the reads at once.
+
+import (
+	"sync"
+)
+
+// maxGroupBytes : The maximum size of the records written by a leader at once (the first write of a group is always taken).
+const maxGroupBytes = 1 << 20
+
+// commitRequest : A write waiting in the commit queue.
+type commitRequest struct {
+	records []FileRecord
+	// Applies the records to the main memory once they are in the WAL, its error is the result of the write.
+	apply func() error
+	// Called by the leader before the records are written, the records are not written if it fails. Requires alone.
+	check func() error
+	// The request is written in a group of its own (used to switch the WAL segment or the main memory).
+	alone bool
+	// The records are written to the WAL as a single batch record.
+	batch bool
+	err   error
+	done  bool
+}
+
+type commitQueue struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue []*commitRequest
+	// Number of groups written, for the tests.
+	groups int
+}
+
+func newCommitQueue() *commitQueue {
+	q := &commitQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// commit writes the records to the WAL, then calls apply, in the order of the commits. The sequence numbers of the records are set
+// before they are written, apply finds them in the records.
+// It returns the error of the WAL write, or else the error of apply.
+func (s *PersMem) commit(records []FileRecord, apply func() error) error {
+	return s.commitRequest(&commitRequest{records: records, apply: apply})
+}
+
+// commitBatch writes the records to the WAL as a single batch record, then calls apply, in the order of the commits.
+func (s *PersMem) commitBatch(records []FileRecord, apply func() error) error {
+	return s.commitRequest(&commitRequest{records: records, apply: apply, batch: true})
+}
+
+// commitChecked calls check once all the previous commits are done, and before any later commit starts. If check succeeds, the
+// records are written and applied as by commit, else its error is returned.
+func (s *PersMem) commitChecked(records []FileRecord, check func() error, apply func() error) error {
+	return s.commitRequest(&commitRequest{records: records, check: check, apply: apply, alone: true})
+}
+
+// commitBatchChecked calls check as commitChecked does, and if it succeeds writes the records as a single batch record, as
+// commitBatch does.
+func (s *PersMem) commitBatchChecked(records []FileRecord, check func() error, apply func() error) error {
+	return s.commitRequest(&commitRequest{records: records, check: check, apply: apply, alone: true, batch: true})
+}
+
+// commitAlone calls apply once all the previous commits are done, and before any later commit starts.
+func (s *PersMem) commitAlone(apply func() error) error {
+	return s.commitRequest(&commitRequest{apply: apply, alone: true})
+}
+
+func (s *PersMem) commitRequest(req *commitRequest) error {
+	q := s.cq
+
+	q.mu.Lock()
+	q.queue = append(q.queue, req)
+	for !req.done && q.queue[0] != req {
+		q.cond.Wait()
+	}
+	if req.done {
+		// A leader wrote this request.
+		q.mu.Unlock()
+		return req.err
+	}
+
+	// This writer is the leader, take the queued requests.
+	group := []*commitRequest{req}
+	size := recordsSize(req.records)
+	for _, r := range q.queue[1:] {
+		if req.alone {
+			break
+		}
+		size += recordsSize(r.records)
+		if size > maxGroupBytes || r.alone {
+			break
+		}
+		group = append(group, r)
+	}
+	q.mu.Unlock()
+
+	// A single WAL write and sync for the whole group.
+	var err error
+	if req.check != nil {
+		err = req.check()
+	}
+	var data []byte
+	n := uint64(0)
+	for _, r := range group {
+		if err != nil {
+			break
+		}
+		for i := range r.records {
+			n++
+			r.records[i].Seq = s.seq + n
+		}
+		if r.batch && len(r.records) > 0 {
+			data, err = appendWalBatch(data, r.records)
+			continue
+		}
+		for _, record := range r.records {
+			if data, err = appendWalRecord(data, record); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil && len(data) > 0 {
+		err = s.wal.writeFrames(data)
+	}
+	// The records written get the next sequence numbers.
+	if err == nil {
+		s.seq += n
+	}
+
+	for _, r := range group {
+		r.err = err
+		if err == nil && r.apply != nil {
+			r.err = r.apply()
+		}
+	}
+	s.visible.Store(s.seq)
+
+	q.mu.Lock()
+	for _, r := range group {
+		r.done = true
+	}
+	q.queue = q.queue[len(group):]
+	q.groups++
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	return req.err
+}
+
+func recordsSize(records []FileRecord) int {
+	size := 0
+	for _, r := range records {
+		size += walRecordHeaderSize + recordFixedSize + len(r.Key) + len(r.Value)
+	}
+	return size
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPersMem(t *testing.T) *PersMem {
+	mem, err := newPersMem(t.TempDir(), DefaultOptions())
+	assert.NoError(t, err)
+	t.Cleanup(func() { mem.Close() })
+	return mem
+}
+
+// waitQueued waits until n writes are in the commit queue.
+func waitQueued(q *commitQueue, n int) {
+	for {
+		q.mu.Lock()
+		l := len(q.queue)
+		q.mu.Unlock()
+		if l >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	mem := newTestPersMem(t)
+
+	// Block the WAL so that the first leader waits while the other writers queue up.
+	mem.wal.mu.Lock()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, mem.SetM("Key_0", "Value_0"))
+	}()
+	waitQueued(mem.cq, 1)
+
+	errs := make([]error, 11)
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = mem.SetM(fmt.Sprintf("Key_%d", i), fmt.Sprintf("Value_%d", i))
+		}(i)
+	}
+	// A deletion of a missing key in the same group gets its own result.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := mem.DelM("Missing")
+		assert.EqualError(t, err, "Key Not Found")
+	}()
+	waitQueued(mem.cq, 12)
+
+	mem.wal.mu.Unlock()
+	wg.Wait()
+
+	// The first leader wrote its own write, the next one wrote all the others at once.
+	assert.Equal(t, 2, mem.cq.groups)
+	for i := 1; i <= 10; i++ {
+		assert.NoError(t, errs[i])
+	}
+
+	// All the writes are in the WAL and in memory.
+	assert.Equal(t, 12, mem.store.Len())
+	mem.store = NewSkipList()
+	assert.NoError(t, mem.Load())
+	assert.Equal(t, 12, mem.store.Len())
+	for i := 0; i <= 10; i++ {
+		v, err := mem.GetM(fmt.Sprintf("Key_%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, Tuple{"set", fmt.Sprintf("Value_%d", i), 0}, v)
+	}
+}
+
+func TestGroupCommitConcurrentWriters(t *testing.T) {
+	mem := newTestPersMem(t)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				assert.NoError(t, mem.SetM(fmt.Sprintf("Key_%d_%d", g, i), "Value"))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, mem.cq.groups, 400)
+	assert.Equal(t, 400, mem.store.Len())
+	mem.store = NewSkipList()
+	assert.NoError(t, mem.Load())
+	assert.Equal(t, 400, mem.store.Len())
+}
+
+func TestGroupCommitChecked(t *testing.T) {
+	mem := newTestPersMem(t)
+	assert.NoError(t, mem.SetM("Key", "Value"))
+
+	// A failed check writes nothing.
+	err := mem.DelIf("Key", func() error { return errors.New("Check failed") })
+	assert.EqualError(t, err, "Check failed")
+	v, err := mem.GetM("Key")
+	assert.NoError(t, err)
+	assert.Equal(t, Tuple{"set", "Value", 0}, v)
+	assert.Equal(t, uint64(1), mem.seq)
+
+	// The check sees the writes committed before it.
+	var seen Tuple
+	assert.NoError(t, mem.DelIf("Key", func() error {
+		seen, err = mem.GetM("Key")
+		return err
+	}))
+	assert.Equal(t, Tuple{"set", "Value", 0}, seen)
+	v, err = mem.GetM("Key")
+	assert.NoError(t, err)
+	assert.Equal(t, Tuple{"del", "", 0}, v)
+	assert.Equal(t, uint64(2), mem.seq)
+}
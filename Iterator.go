@@ -0,0 +1,492 @@
+package main
+
+// An iterator goes through the records of the store whose keys are in [start, end), in key order. It merges the sorted records of
+// the main memory, of the immutable memory and of the SST files that overlap the range (loaded into memory or read on the disk) :
+// for each key only the newest record is seen (or the merge operands folded with the records under them, see Merge.go), and the
+// deleted or expired keys are skipped. It reads at a sequence number (see Snapshot.go) : the
+// records written after it are ignored, even those of the files and the memories it reads. The iterator goes both ways : Next and Prev can be
+// mixed, a change of direction seeks all the sources again around the current key.
+
+// The SST files read by an iterator are the live ones when it is created, a compaction that merges them meanwhile only deletes them
+// once the iterator is closed (see sstFile.refs), so an iterator must always be closed. The records written during the iteration are
+// never seen.
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// iterSource : The sorted records of the main memory, of the immutable memory or of an SST file.
+type iterSource interface {
+	// seek moves to the first record whose key is not before key.
+	seek(key string) error
+	// seekForPrev moves to the last record whose key is not after key.
+	seekForPrev(key string) error
+	seekToLast() error
+	// current returns the record the source is on, false once its records are exhausted (in either direction). A source may hold
+	// several records of a key, from the newest to the oldest.
+	current() (FileRecord, bool)
+	next() error
+	prev() error
+}
+
+// memSource : The records of a skiplist, all the records of the key the skiplist iterator is on are read at once.
+type memSource struct {
+	sl *SkipList
+	it *SkipListIterator
+	// The records of the key, from the newest to the oldest.
+	records []FileRecord
+	i       int
+}
+
+// load reads the records of the key the skiplist iterator is on, and moves to the newest one (or the oldest one going backward).
+func (s *memSource) load(backward bool) {
+	s.records = nil
+	if s.it.Valid() {
+		s.records = s.it.Records()
+	}
+	s.i = 0
+	if backward {
+		s.i = len(s.records) - 1
+	}
+}
+
+func (s *memSource) seek(key string) error {
+	s.it = s.sl.Seek(key)
+	s.load(false)
+	return nil
+}
+
+func (s *memSource) seekForPrev(key string) error {
+	s.it = s.sl.SeekForPrev(key)
+	s.load(true)
+	return nil
+}
+
+func (s *memSource) seekToLast() error {
+	s.it = s.sl.SeekToLast()
+	s.load(true)
+	return nil
+}
+
+func (s *memSource) current() (FileRecord, bool) {
+	if s.i < 0 || s.i >= len(s.records) {
+		return FileRecord{}, false
+	}
+	return s.records[s.i], true
+}
+
+func (s *memSource) next() error {
+	if s.i++; s.i == len(s.records) {
+		s.it.Next()
+		s.load(false)
+	}
+	return nil
+}
+
+func (s *memSource) prev() error {
+	if s.i--; s.i < 0 {
+		s.it.Prev()
+		s.load(true)
+	}
+	return nil
+}
+
+// mapSource : The records of an SST file loaded into memory.
+type mapSource struct {
+	mp *SSTMap
+	i  int
+}
+
+func (s *mapSource) seek(key string) error {
+	s.i = sort.Search(len(s.mp.records), func(i int) bool { return s.mp.records[i].Key >= key })
+	return nil
+}
+
+func (s *mapSource) seekForPrev(key string) error {
+	s.i = sort.Search(len(s.mp.records), func(i int) bool { return s.mp.records[i].Key > key }) - 1
+	return nil
+}
+
+func (s *mapSource) seekToLast() error {
+	s.i = len(s.mp.records) - 1
+	return nil
+}
+
+func (s *mapSource) current() (FileRecord, bool) {
+	if s.i < 0 || s.i >= len(s.mp.records) {
+		return FileRecord{}, false
+	}
+	return s.mp.records[s.i], true
+}
+
+func (s *mapSource) next() error {
+	s.i++
+	return nil
+}
+
+func (s *mapSource) prev() error {
+	s.i--
+	return nil
+}
+
+// fileSource : The records of an SST file read on the disk.
+type fileSource struct {
+	c *sstCursor
+}
+
+func (s *fileSource) seek(key string) error {
+	return s.c.seek(key)
+}
+
+func (s *fileSource) seekForPrev(key string) error {
+	return s.c.seekForPrev(key)
+}
+
+func (s *fileSource) seekToLast() error {
+	return s.c.seekToLast()
+}
+
+func (s *fileSource) current() (FileRecord, bool) {
+	if !s.c.valid() {
+		return FileRecord{}, false
+	}
+	return s.c.record(), true
+}
+
+func (s *fileSource) next() error {
+	return s.c.next()
+}
+
+func (s *fileSource) prev() error {
+	return s.c.prev()
+}
+
+// Iterator : Goes through the records of the store between two keys, see above.
+type Iterator struct {
+	start string
+	// "" for no upper bound.
+	end string
+	// From the newest to the oldest.
+	sources []iterSource
+	// The SST files read, and the files opened.
+	files  []*sstFile
+	opened []*os.File
+	// The sequence number the records are read at.
+	seq uint64
+	// The values expired at this time (Unix nanoseconds) are skipped, it is the time the iterator was created.
+	now     int64
+	mergeOp MergeOperator
+
+	key   string
+	value string
+	valid bool
+	err   error
+	// The direction of the last move : when going forward the sources are after the current key, else before it.
+	reverse bool
+}
+
+// NewIterator returns an iterator on the records whose keys are in [start, end), positioned on the first one. An empty end has no
+// upper bound. The iterator must be closed.
+func (kv *MyKvStore) NewIterator(start, end string) (*Iterator, error) {
+	return kv.newIterator(start, end, latestSeq)
+}
+
+// newIterator returns an iterator on the records of [start, end) whose sequence number is not after seq, latestSeq reads at the last
+// write applied.
+func (kv *MyKvStore) newIterator(start, end string, seq uint64) (*Iterator, error) {
+	it := &Iterator{start: start, end: end, seq: seq, now: time.Now().UnixNano(), mergeOp: kv.sstM.mergeOp}
+
+	// The memories and the files are taken at once : no flush or compaction ends in between, and every record of the files is
+	// older than the last write applied.
+	m := kv.sstM
+	m.mu.RLock()
+	kv.memDB.mu.RLock()
+	if it.seq == latestSeq {
+		it.seq = kv.memDB.lastSeq()
+	}
+	store, imm := kv.memDB.store, kv.memDB.imm
+	kv.memDB.mu.RUnlock()
+	it.sources = append(it.sources, &memSource{sl: store})
+	if imm != nil {
+		it.sources = append(it.sources, &memSource{sl: imm})
+	}
+
+	for i := len(m.files) - 1; i >= 0; i-- {
+		f := m.files[i]
+		if f.Largest < start || (end != "" && f.Smallest >= end) {
+			continue
+		}
+		f.refs.Add(1)
+		it.files = append(it.files, f)
+	}
+	m.mu.RUnlock()
+
+	for _, f := range it.files {
+		if f.mem != nil {
+			it.sources = append(it.sources, &mapSource{mp: f.mem})
+			continue
+		}
+		file, err := os.Open(sstFileName(directory, f.Num))
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.opened = append(it.opened, file)
+		table, err := openSSTTable(file)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.sources = append(it.sources, &fileSource{c: table.newCursor()})
+	}
+
+	it.Seek(start)
+	if it.err != nil {
+		err := it.err
+		it.Close()
+		return nil, err
+	}
+	return it, nil
+}
+
+// ScanPrefix returns an iterator on the records whose keys start with prefix, positioned on the first one. The iterator must be
+// closed.
+func (kv *MyKvStore) ScanPrefix(prefix string) (*Iterator, error) {
+	return kv.NewIterator(prefix, prefixEnd(prefix))
+}
+
+// prefixEnd returns the smallest key after all the keys starting with prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Seek moves the iterator to the first record whose key is not before key (and not before start).
+func (it *Iterator) Seek(key string) {
+	if key < it.start {
+		key = it.start
+	}
+	it.reverse = false
+	for _, s := range it.sources {
+		if err := s.seek(key); err != nil {
+			it.fail(err)
+			return
+		}
+	}
+	it.findNext()
+}
+
+// SeekForPrev moves the iterator to the last record whose key is not after key (and before end).
+func (it *Iterator) SeekForPrev(key string) {
+	it.reverse = true
+	for _, s := range it.sources {
+		if err := s.seekForPrev(key); err != nil {
+			it.fail(err)
+			return
+		}
+	}
+	it.findPrev()
+}
+
+// SeekToLast moves the iterator to the last record before end.
+func (it *Iterator) SeekToLast() {
+	if it.end != "" {
+		// The records of end itself are skipped by findPrev.
+		it.SeekForPrev(it.end)
+		return
+	}
+	it.reverse = true
+	for _, s := range it.sources {
+		if err := s.seekToLast(); err != nil {
+			it.fail(err)
+			return
+		}
+	}
+	it.findPrev()
+}
+
+// Next moves the iterator to the next record.
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+	if it.reverse {
+		// The sources are before the current key, move them after it.
+		it.reverse = false
+		for _, s := range it.sources {
+			if err := s.seek(it.key); err != nil {
+				it.fail(err)
+				return
+			}
+			if err := skipKey(s, it.key, s.next); err != nil {
+				it.fail(err)
+				return
+			}
+		}
+	}
+	it.findNext()
+}
+
+// Prev moves the iterator to the previous record.
+func (it *Iterator) Prev() {
+	if !it.valid {
+		return
+	}
+	if !it.reverse {
+		// The sources are after the current key, move them before it.
+		it.reverse = true
+		for _, s := range it.sources {
+			if err := s.seekForPrev(it.key); err != nil {
+				it.fail(err)
+				return
+			}
+			if err := skipKey(s, it.key, s.prev); err != nil {
+				it.fail(err)
+				return
+			}
+		}
+	}
+	it.findPrev()
+}
+
+// skipKey moves the source with move while it is on a record of key.
+func skipKey(s iterSource, key string, move func() error) error {
+	for r, ok := s.current(); ok && r.Key == key; r, ok = s.current() {
+		if err := move(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (it *Iterator) fail(err error) {
+	it.err, it.valid = err, false
+}
+
+// findNext moves the iterator to the smallest key of the sources, skipping the deleted or expired keys and the keys written after the sequence
+// number of the iterator.
+func (it *Iterator) findNext() {
+	for {
+		var key string
+		found := false
+		for _, s := range it.sources {
+			if r, ok := s.current(); ok && (!found || r.Key < key) {
+				key, found = r.Key, true
+			}
+		}
+		if !found || (it.end != "" && key >= it.end) {
+			it.valid = false
+			return
+		}
+
+		// The records seen from the newest source, the records under the first value or deletion are shadowed.
+		v := &mergeValue{now: it.now}
+		more := true
+		for _, s := range it.sources {
+			for r, ok := s.current(); ok && r.Key == key; r, ok = s.current() {
+				if more && r.Seq <= it.seq {
+					more = v.add(r)
+				}
+				if err := s.next(); err != nil {
+					it.fail(err)
+					return
+				}
+			}
+		}
+
+		if it.found(key, v) {
+			return
+		}
+	}
+}
+
+// found moves the iterator to the key if it has a value, an error of the merge operator stops the iterator.
+func (it *Iterator) found(key string, v *mergeValue) bool {
+	val, exists, err := v.value(it.mergeOp, key)
+	if err != nil {
+		it.fail(err)
+		return true
+	}
+	if exists {
+		it.key, it.value, it.valid = key, val, true
+	}
+	return exists
+}
+
+// findPrev moves the iterator to the largest key of the sources before end, skipping the deleted or expired keys.
+func (it *Iterator) findPrev() {
+	for {
+		var key string
+		found := false
+		for _, s := range it.sources {
+			if r, ok := s.current(); ok && (!found || r.Key > key) {
+				key, found = r.Key, true
+			}
+		}
+		if !found || key < it.start {
+			it.valid = false
+			return
+		}
+
+		// The records seen as by findNext. Going backward, the records of a source are met from the oldest to the newest.
+		v := &mergeValue{now: it.now}
+		more := true
+		for _, s := range it.sources {
+			var seen []FileRecord
+			for r, ok := s.current(); ok && r.Key == key; r, ok = s.current() {
+				if r.Seq <= it.seq {
+					seen = append(seen, r)
+				}
+				if err := s.prev(); err != nil {
+					it.fail(err)
+					return
+				}
+			}
+			for i := len(seen) - 1; i >= 0 && more; i-- {
+				more = v.add(seen[i])
+			}
+		}
+
+		if (it.end == "" || key < it.end) && it.found(key, v) {
+			return
+		}
+	}
+}
+
+// Valid reports whether the iterator is on a record, it is false once the records are exhausted or after an error.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+// Err returns the error met while reading the records, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the SST files read by the iterator.
+func (it *Iterator) Close() error {
+	for _, file := range it.opened {
+		file.Close()
+	}
+	for _, f := range it.files {
+		f.unref()
+	}
+	it.opened, it.files, it.sources, it.valid = nil, nil, nil, false
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// scanTestStore returns the records of [start, end) seen by an iterator.
+func scanTestStore(t *testing.T, kv *MyKvStore, start, end string) map[string]string {
+	it, err := kv.NewIterator(start, end)
+	assert.NoError(t, err)
+	defer it.Close()
+	got := make(map[string]string)
+	prev := ""
+	for ; it.Valid(); it.Next() {
+		assert.Less(t, prev, it.Key())
+		prev = it.Key()
+		got[it.Key()] = it.Value()
+	}
+	assert.NoError(t, it.Err())
+	return got
+}
+
+// reverseScanTestStore returns the keys of [start, end) seen by an iterator going backward, with their values.
+func reverseScanTestStore(t *testing.T, kv *MyKvStore, start, end string) ([]string, map[string]string) {
+	it, err := kv.NewIterator(start, end)
+	assert.NoError(t, err)
+	defer it.Close()
+	var keys []string
+	got := make(map[string]string)
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		keys = append(keys, it.Key())
+		got[it.Key()] = it.Value()
+	}
+	assert.NoError(t, it.Err())
+	return keys, got
+}
+
+// fillTestStore writes records spread over the main memory and the SST files, and returns the records expected.
+func fillTestStore(t *testing.T, kv *MyKvStore) map[string]string {
+	// Each round overwrites the keys, and deletes some of them, so that their records are spread over the main memory and the
+	// SST files.
+	want := make(map[string]string)
+	for r := 0; r < 5; r++ {
+		for k := r; k < 300; k += 2 {
+			key, value := fmt.Sprintf("Key_%03d", k), fmt.Sprintf("Value_%d_%d", r, k)
+			assert.NoError(t, kv.Set(key, value))
+			want[key] = value
+		}
+		for k := r; k < 300; k += 7 {
+			key := fmt.Sprintf("Key_%03d", k)
+			if _, err := kv.Del(key); err == nil {
+				delete(want, key)
+			}
+		}
+		kv.flushes.Wait()
+	}
+	assert.NotEmpty(t, kv.sstM.metas())
+	return want
+}
+
+// readFromDisk drops the SST files loaded into memory, so that the iterators read them on the disk.
+func readFromDisk(kv *MyKvStore) {
+	kv.sstM.mu.Lock()
+	for _, f := range kv.sstM.files {
+		f.mem = nil
+	}
+	kv.sstM.mu.Unlock()
+}
+
+func TestIterator(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+	want := fillTestStore(t, kv)
+
+	inRange := func(start, end string) map[string]string {
+		res := make(map[string]string)
+		for k, v := range want {
+			if k >= start && (end == "" || k < end) {
+				res[k] = v
+			}
+		}
+		return res
+	}
+	assert.Equal(t, inRange("Key_050", "Key_150"), scanTestStore(t, kv, "Key_050", "Key_150"))
+	assert.Equal(t, want, scanTestStore(t, kv, "", ""))
+	assert.Empty(t, scanTestStore(t, kv, "Key_150", "Key_150"))
+
+	// The same records are read from the disk.
+	readFromDisk(kv)
+	assert.Equal(t, inRange("Key_050", "Key_150"), scanTestStore(t, kv, "Key_050", "Key_150"))
+
+	// Seek moves to the first key not deleted, never before start.
+	first := func(from string) string {
+		var keys []string
+		for k := range inRange(from, "") {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys[0]
+	}
+	it, err := kv.NewIterator("Key_100", "Key_200")
+	assert.NoError(t, err)
+	defer it.Close()
+	it.Seek("Key_147")
+	assert.True(t, it.Valid())
+	assert.Equal(t, first("Key_147"), it.Key())
+	assert.Equal(t, want[first("Key_147")], it.Value())
+	it.Seek("Key_000")
+	assert.True(t, it.Valid())
+	assert.Equal(t, first("Key_100"), it.Key())
+}
+
+func TestIteratorKeepsMergedFiles(t *testing.T) {
+	chdirTemp(t)
+	m, err := NewSSTManager(defLoad, treshold)
+	assert.NoError(t, err)
+	defer m.manifest.Close()
+	kv := &MyKvStore{sstM: m, memDB: openTestPersMem(t, t.TempDir())}
+
+	var records []FileRecord
+	for k := 0; k < 100; k++ {
+		records = append(records, FileRecord{Operation: "set", Key: fmt.Sprintf("Key_%03d", k), Value: "Old"})
+	}
+	old := addTestFile(t, m, records)
+	for k := range records {
+		records[k].Value = "New"
+	}
+	newer := addTestFile(t, m, records)
+
+	// The files merged while the iterator reads them are deleted once it is closed.
+	it, err := kv.NewIterator("", "")
+	assert.NoError(t, err)
+	assert.NoError(t, m.compact(&compaction{inputs: []fileMeta{newer, old}, outputLevel: 1, maxOutputSize: maxFileSize}, nil))
+	_, err = os.Stat(sstFileName(directory, old.Num))
+	assert.NoError(t, err)
+
+	n := 0
+	for ; it.Valid(); it.Next() {
+		assert.Equal(t, "New", it.Value())
+		n++
+	}
+	assert.Equal(t, 100, n)
+	it.Close()
+	_, err = os.Stat(sstFileName(directory, old.Num))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestIteratorReverse(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+	want := fillTestStore(t, kv)
+
+	for _, disk := range []bool{false, true} {
+		if disk {
+			readFromDisk(kv)
+		}
+		for _, r := range [][2]string{{"", ""}, {"Key_050", "Key_150"}, {"Key_100", ""}} {
+			keys, got := reverseScanTestStore(t, kv, r[0], r[1])
+			assert.Equal(t, scanTestStore(t, kv, r[0], r[1]), got)
+			assert.True(t, sort.IsSorted(sort.Reverse(sort.StringSlice(keys))))
+			assert.Equal(t, len(got), len(keys))
+		}
+	}
+
+	var keys []string
+	for k := range want {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	it, err := kv.NewIterator("", "")
+	assert.NoError(t, err)
+	defer it.Close()
+
+	// SeekForPrev moves to the last key not deleted, never after end.
+	i := sort.SearchStrings(keys, "Key_147")
+	if i == len(keys) || keys[i] != "Key_147" {
+		i--
+	}
+	it.SeekForPrev("Key_147")
+	assert.True(t, it.Valid())
+	assert.Equal(t, keys[i], it.Key())
+	assert.Equal(t, want[keys[i]], it.Value())
+
+	// Next and Prev can be mixed.
+	it.Next()
+	assert.Equal(t, keys[i+1], it.Key())
+	it.Next()
+	assert.Equal(t, keys[i+2], it.Key())
+	it.Prev()
+	assert.Equal(t, keys[i+1], it.Key())
+	it.Prev()
+	it.Prev()
+	assert.Equal(t, keys[i-1], it.Key())
+	it.Next()
+	assert.Equal(t, keys[i], it.Key())
+
+	it.SeekForPrev("A")
+	assert.False(t, it.Valid())
+}
+
+func TestScanPrefix(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+
+	for _, user := range []string{"1", "12", "2"} {
+		for k := 0; k < 200; k++ {
+			assert.NoError(t, kv.Set(fmt.Sprintf("user:%s:%03d", user, k), user))
+		}
+	}
+	kv.flushes.Wait()
+	assert.NotEmpty(t, kv.sstM.metas())
+	// The newest entries are deleted in the main memory, over their records in the SST files.
+	for k := 195; k < 200; k++ {
+		_, err := kv.Del(fmt.Sprintf("user:1:%03d", k))
+		assert.NoError(t, err)
+	}
+
+	// The newest 3 entries of the user 1.
+	it, err := kv.ScanPrefix("user:1:")
+	assert.NoError(t, err)
+	var newest []string
+	for it.SeekToLast(); it.Valid() && len(newest) < 3; it.Prev() {
+		assert.Equal(t, "1", it.Value())
+		newest = append(newest, it.Key())
+	}
+	assert.NoError(t, it.Err())
+	it.Close()
+	assert.Equal(t, []string{"user:1:194", "user:1:193", "user:1:192"}, newest)
+
+	it, err = kv.ScanPrefix("user:1")
+	assert.NoError(t, err)
+	n := 0
+	for ; it.Valid(); it.Next() {
+		n++
+	}
+	it.Close()
+	assert.Equal(t, 195+200, n)
+
+	assert.Equal(t, "user;", prefixEnd("user:"))
+	assert.Equal(t, "b", prefixEnd("a\xff\xff"))
+	assert.Equal(t, "", prefixEnd("\xff"))
+	assert.Equal(t, "", prefixEnd(""))
+}
+
+func TestIteratorReverseDuplicates(t *testing.T) {
+	chdirTemp(t)
+	m, err := NewSSTManager(defLoad, treshold)
+	assert.NoError(t, err)
+	defer m.manifest.Close()
+	kv := &MyKvStore{sstM: m, memDB: openTestPersMem(t, t.TempDir())}
+
+	// The files merged before the deduplication hold several records of a key, the newest first.
+	addTestFile(t, m, []FileRecord{
+		{Operation: "set", Key: "a", Value: "1"},
+		{Operation: "set", Key: "b", Value: "New"},
+		{Operation: "set", Key: "b", Value: "Old"},
+		{Operation: "del", Key: "c"},
+		{Operation: "set", Key: "c", Value: "Old"},
+	})
+	readFromDisk(kv)
+
+	keys, got := reverseScanTestStore(t, kv, "", "")
+	assert.Equal(t, []string{"b", "a"}, keys)
+	assert.Equal(t, map[string]string{"a": "1", "b": "New"}, got)
+	assert.Equal(t, got, scanTestStore(t, kv, "", ""))
+}
@@ -1,12 +1,10 @@
 package main
 
 import (
-	"encoding/binary"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"os"
 	"sync"
+	"time"
 )
 
 // We will explain the following constants.
@@ -14,36 +12,87 @@ import (
 // 2. directory : This is the directory where we will store the SST files.
 // 3. ext : This is the temporary extension of the SST files (To recover from failures).
 // 4. defLoad : This is the default number of SST files that we will load into memory (for performance concerns).
-// 5. treshold : This is the maximum number of records that we will store in the main memory before flushing to SST files.
-// 6. sysVers : This is the system version (for future use). (We will use it to check if the SST files are compatible with the current system
-// version).
-// 7. mergeThreshold : This is the tolerable number of SST files that we can have when the system starts.
+// 5. treshold : This is the maximum number of records that we will store in the main memory before flushing to SST files. The main
+// memory is usually flushed before, once it uses Options.MemtableSize bytes.
+// 6. sysVers : This is the system version, written in the header of every SST file. (We use it to check if the SST files are compatible
+// with the current system, and to pick the record encoding of the file).
+// sysVersJSON, sysVersBinary, sysVersBlocks, sysVersFilter, sysVersChecksum, sysVersSeq, sysVersTTL : Each format the SST files were written with, the files written with an
+// older format are still readable.
+// 7. l0CompactionTrigger : This is the number of SST files of L0 (the files flushed from the main memory) that starts a compaction.
+// maxLevels : This is the number of levels of SST files (see Compaction.go).
+// levelBaseSize, levelSizeMultiplier : The size target of L1 is levelBaseSize bytes, each deeper level is levelSizeMultiplier times
+// larger.
+// maxFileSize : This is the maximum size of an SST file written by a compaction.
+// 8. blockSize : This is the minimum size of a data block in the SST files, a lookup reads a single block.
+// 9. walDirectory : This is the directory where we will store the WAL segments.
 
 // In this project We tried to implement the singleton design pattern, you can still change the system settings by changing the consts
 // defined below.
 
-// We used an Auto Compaction at the Start and Stop of the kv store, the compaction algorithm keeps merging the SST files until the number
-// of SST files is less than 10. You can change this number by changing the constant "mergeTreshold".
+// We used an Auto Compaction in the background while the kv store runs, the compaction strategy chosen in the options picks the SST files
+// to merge until no compaction is needed. The default leveled compaction keeps merging the SST files into the deeper levels until L0 holds
+// less than "l0CompactionTrigger" files and every level is within its size target.
 
-// We used a threshold to flush the main memory to SST files, you can change this number by changing the constant "treshold".
+// We used a threshold to flush the main memory to SST files, the number of bytes it uses, set by Options.MemtableSize. The number of
+// records is a second limit, you can change this number by changing the constant "treshold".
 // you can still change the threshold and the default number of SST files loaded into memory.
+// The write that fills the main memory only freezes it (see TreeMap.go), the frozen memory is written to an SST file in the background
+// while the writes go on. A single flush runs at a time, the main memory filled during a flush is frozen once it is done.
 
-// We used Go routines to start the treemap and sstManager structures Concurrently, We also used go routines to load the SST files into
+// We used Go routines to start the skiplist and sstManager structures Concurrently, We also used go routines to load the SST files into
 // memory Concurrently.
 
+// The kv store is safe for concurrent use (the HTTP server calls it from a goroutine per request) :
+// - The writes go through a single writer path, the group commit (see GroupCommit.go) : the commit leader appends them to the WAL and
+// applies them to the main memory, one at a time.
+// - The reads take no lock on the main memory (see SkipList.go), they search the main memory, then the immutable memory, then the
+// SST files. A flush installs its SST file before dropping the immutable memory, and a compaction installs its files before
+// deleting its inputs, so a record is always found in one of them.
+// - The SST files searched are fixed for the whole search (it holds mySSTManager.mu), the files merged by a compaction are deleted
+// once the searches that could read them are done.
+
 const magicNumber uint64 = 0x1234567890ABCDEF
 const directory string = "SSTFiles"
+const walDirectory string = "WALFiles"
 const ext string = ".tmp"
 const defLoad uint64 = 1000
-const treshold uint64 = 1000
-const sysVers uint64 = 110011
-const mergeThreshold uint64 = 10
+const treshold uint64 = 100000
+const sysVers uint64 = 110017
+const sysVersJSON uint64 = 110011
+const sysVersBinary uint64 = 110012
+const sysVersBlocks uint64 = 110013
+const sysVersFilter uint64 = 110014
+const sysVersChecksum uint64 = 110015
+const sysVersSeq uint64 = 110016
+const sysVersTTL uint64 = 110017
+const l0CompactionTrigger = 4
+const maxLevels = 7
+const levelBaseSize int64 = 10 << 20
+const levelSizeMultiplier = 10
+const maxFileSize int64 = 2 << 20
+const blockSize int = 4096
 
 // The kv store interface defines the methods for any kv Store instance.(Get, Set, Del, Start, Stop ...)
 type KVStore interface {
 	Get(string) (string, error)
 	Set(string, string) error
+	// SetWithTTL writes a value that expires after a duration.
+	SetWithTTL(string, string, time.Duration) error
 	Del(string) (string, error)
+	// The conditional writes (see Conditional.go).
+	CompareAndSwap(key string, expected string, val string) error
+	SetIfAbsent(key string, val string) error
+	DeleteIfEquals(key string, expected string) error
+	// Merge writes an operand folded into the value by the merge operator of the store (see Merge.go).
+	Merge(key string, operand string) error
+	// Write writes the puts and deletes of a batch at once (see WriteBatch.go).
+	Write(*WriteBatch) error
+	// NewIterator goes through the keys of [start, end) in order (see Iterator.go).
+	NewIterator(start, end string) (*Iterator, error)
+	// ScanPrefix goes through the keys starting with a prefix, in order or backward.
+	ScanPrefix(prefix string) (*Iterator, error)
+	// Begin starts an optimistic transaction (see Txn.go).
+	Begin() *Txn
 	Start() error
 	Stop() error
 }
@@ -54,22 +103,54 @@ type MyKvStore struct {
 	loadCount  int
 	memDB      *PersMem
 	sysVersion uint64
+
+	// Protects flushing, set while the immutable memory is written to an SST file.
+	flushMu  sync.Mutex
+	flushing bool
+	// The flush in progress, waited for by Stop.
+	flushes sync.WaitGroup
 }
 
 // NewKeyValueStore creates a new instance of the KeyValueStore.
 
 func NewKeyValueStore() (*MyKvStore, error) {
+	return NewKeyValueStoreWithOptions(DefaultOptions())
+}
+
+// NewKeyValueStoreWithOptions creates a new instance of the KeyValueStore with the given options.
+func NewKeyValueStoreWithOptions(opts Options) (*MyKvStore, error) {
 	// Create the SST manager.
 	sstM, err := NewSSTManager(defLoad, treshold)
 	if err != nil {
 		panic(err.Error())
 	}
+	sstM.bitsPerKey = opts.BloomBitsPerKey
+	if opts.Compaction != nil {
+		sstM.strategy = opts.Compaction
+	}
+	sstM.maxCompactions = opts.MaxBackgroundCompactions
+	if err := sstM.setMergeOperator(opts.MergeOperator); err != nil {
+		sstM.manifest.Close()
+		return nil, err
+	}
 
-	// Create the main memory.
-	memDB, err := NewPersMem()
+	// Create the main memory, the WAL written before the segments becomes the newest segment.
+	if err := adoptLegacyWAL(WalName, walDirectory); err != nil {
+		sstM.manifest.Close()
+		return nil, err
+	}
+	memDB, err := newPersMem(walDirectory, opts)
 	if err != nil {
 		panic(err.Error())
 	}
+	// The records of the SST files come first in the sequence, the WAL segments already written to SST files are dropped.
+	memDB.seq = sstM.manifest.lastSeq
+	memDB.visible.Store(memDB.seq)
+	if err := memDB.skipSegments(sstM.manifest.logNum); err != nil {
+		memDB.Close()
+		sstM.manifest.Close()
+		return nil, err
+	}
 
 	return &MyKvStore{
 		sstM:       sstM,
@@ -81,220 +162,255 @@ func NewKeyValueStore() (*MyKvStore, error) {
 
 func (kv *MyKvStore) Start() error {
 
-	err := kv.SSTCompaction()
-	if err != nil {
-		return err
-	}
-
-	kv.sstM.sstCount, err = CheckAndClean()
-	if err != nil {
-		return err
-	}
-
 	// Create a wait group.
 	wg := &sync.WaitGroup{}
+	var walErr, sstErr error
 
-	go func(wg *sync.WaitGroup) error {
+	wg.Add(2)
+	go func(wg *sync.WaitGroup) {
 		defer wg.Done()
 
-		wg.Add(1)
 		// Load the WAL file into memory.
-		err := kv.memDB.Load()
-		if err != nil {
-			return err
+		if walErr = kv.memDB.Load(); walErr != nil {
+			return
 		}
 		fmt.Println("WAL file loaded into memory")
-		return nil
 	}(wg)
 
-	go func(wg *sync.WaitGroup) error {
+	go func(wg *sync.WaitGroup) {
 		defer wg.Done()
-		wg.Add(1)
 		// Load the SST files into memory.
-		if err := kv.sstM.LoadALL(); err != nil {
-			return err
+		if sstErr = kv.sstM.LoadALL(); sstErr != nil {
+			return
 		}
 		fmt.Println("SST files loaded into memory")
-		return nil
 	}(wg)
 
 	wg.Wait()
+	if walErr != nil {
+		return walErr
+	}
+	if sstErr != nil {
+		return sstErr
+	}
 
 	fmt.Println("Load Count :", kv.sstM.loadCount)
 	fmt.Println("Load Index:", kv.sstM.loadIdx)
 	fmt.Println("SST Count :", kv.sstM.sstCount)
 	//fmt.Println(kv.sstM.loadCount)
 
+	// The compactions needed run in the background from now on.
+	kv.sstM.startCompactions()
 	return nil
 }
 
-func (kv *MyKvStore) FlushToSST() error {
+// FlushToSST writes the immutable memory to a new SST file. old are the segments that hold its records and maxSeq the sequence number
+// of its newest record (see PersMem.freeze).
+// The older segments are only deleted once the SST file is synced and recorded in the MANIFEST, so a crash at any step leaves either
+// the WAL segments or the SST file (or both) on the disk.
+func (kv *MyKvStore) FlushToSST(old []uint64, maxSeq uint64) error {
 
-	fileName := fmt.Sprintf("%s/SST%d%s", directory, kv.sstM.sstCount, ext)
-	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
+	meta, err := kv.writeSST(kv.sstM.manifest.newFileNumber(), kv.memDB.imm)
+	written := err == nil
+	var f *sstFile
+	if err == nil {
+		// Load the SST file before it is searched.
+		meta.MaxSeq = maxSeq
+		f, err = kv.sstM.openFile(meta)
+	}
+	if err == nil {
+		// The SST file is live once the edit is in the MANIFEST, the old segments are not replayed anymore from then on.
+		err = kv.sstM.logAndApply(versionEdit{Added: []fileMeta{meta}, LastSeq: maxSeq, LogNum: old[len(old)-1] + 1}, f)
+	}
 	if err != nil {
+		// The SST file written is never read, the next flush writes another one. It is kept if the edit made it to the MANIFEST.
+		if written && !kv.sstM.manifest.recorded(meta.Num) {
+			os.Remove(sstFileName(directory, meta.Num))
+		}
+		// The records are still only in the old segments.
+		kv.memDB.thaw()
+		kv.memDB.keepSegments(old)
 		return err
 	}
 
+	// Now the immutable memory is searched in the SST file.
+	kv.memDB.dropImmutable()
+	kv.sstM.wakeCompactions()
+
+	// The records of the old segments are in the SST file.
+	return kv.memDB.dropSegments(old)
+}
+
+// writeSST writes the records of mem to the SST file number num, and makes sure it is on the disk.
+func (kv *MyKvStore) writeSST(num uint64, mem *SkipList) (fileMeta, error) {
+
+	fileName := fmt.Sprintf("%s/SST%d%s", directory, num, ext)
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fileMeta{}, err
+	}
+
 	// Close the file at the end of the function.
 	// if the file is already closed, continue.
 	defer file.Close()
 
-	//file, err := kv.sstM.NextSSTFile()
+	out, err := newSSTWriter(file, kv.sstM.bitsPerKey)
 	if err != nil {
-		return err
+		return fileMeta{}, err
 	}
 
-	// Write magic number:
-	if err := binary.Write(file, binary.LittleEndian, magicNumber); err != nil {
-		return err
+	// Write records, the newest one of each key and the older ones still read by a snapshot (see Snapshot.go), with the merge
+	// operands folded when mem holds a value under them (see Merge.go). The snapshots taken later read the newest records of mem.
+	snapshots := kv.sstM.snapshots.list()
+	now := time.Now().UnixNano()
+	// The SST files may hold older records of any key.
+	bottom := func(string) bool { return false }
+	for it := mem.Iterator(); it.Valid(); it.Next() {
+		kept, _ := keptRecords(it.Records(), snapshots, now, kv.sstM.mergeOp, bottom)
+		for _, record := range kept {
+			if err := out.add(record); err != nil {
+				return fileMeta{}, err
+			}
+		}
 	}
-
-	// Write system version:
-	if err := binary.Write(file, binary.LittleEndian, kv.sysVersion); err != nil {
-		return err
+	if err := out.finish(); err != nil {
+		return fileMeta{}, err
 	}
 
-	// Write the records count:
-	le := uint64(kv.memDB.store.Len())
-	if err := binary.Write(file, binary.LittleEndian, le); err != nil {
-		return err
+	// The WAL segments are deleted once the file is recorded, its records must be on the disk first.
+	if err := file.Sync(); err != nil {
+		return fileMeta{}, err
 	}
 
-	// Write records
-	for it := kv.memDB.store.Iterator(); it.Valid(); it.Next() {
-
-		record := FileRecord{
-			Operation: Operation(it.Value().operation),
-			Key:       it.Key(),
-			Value:     it.Value().value,
-		}
-		// Convert record to JSON
-		data, err := json.Marshal(record)
-		if err != nil {
-			return err
-		}
-
-		// Write the length of the record
-		if err := binary.Write(file, binary.BigEndian, int64(len(data))); err != nil {
-			return err
-		}
-
-		// Write the record data
-		_, err = file.Write(data)
-		if err != nil {
-			return err
-		}
-
-	}
 	// Now that we could perform all operations we need to change file extension to .sst
 	// Remark : The file is not yet officially an SST file.
 
 	file.Close()
-	newfileName := fmt.Sprintf("%s/SST%d.sst", directory, kv.sstM.sstCount)
-	if err := os.Rename(file.Name(), newfileName); err != nil {
-		return err
-	}
-	kv.sstM.sstCount++
-	// Now we need to clear the main memory.
-	if err := kv.memDB.Clear(); err != nil {
-		return err
+	if err := os.Rename(file.Name(), sstFileName(directory, num)); err != nil {
+		return fileMeta{}, err
 	}
 
-	// Now we need to update the SST map.
-	if err := kv.Update(); err != nil {
-		return err
-	}
-
-	return nil
+	// The rename itself must be on the disk.
+	return out.fileMeta(num, 0), syncDir(directory)
 }
 
-func (kv *MyKvStore) Update() error {
-	fileName := fmt.Sprintf("%s/SST%d.sst", directory, kv.sstM.sstCount-1)
-	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return err
+// memtableFull checks if the main memory uses more than the memory budget, or holds more records than the threshold.
+func (kv *MyKvStore) memtableFull() bool {
+	budget := kv.memDB.opts.MemtableSize
+	if budget > 0 && kv.memDB.Size() >= budget {
+		return true
 	}
-	defer file.Close()
+	return uint64(kv.memDB.Len()) > kv.sstM.loadThreshold
+}
 
-	// Create sstmap
-	ss := newSSTMap()
-	if err := ss.LoadToMem(file); err != nil {
-		return err
-	}
-	// Close the file at the end of the function.
-	// if the file is already closed, continue.
+// CheckIfFlush freezes the main memory once it is full, and writes it to an SST file in the background.
+func (kv *MyKvStore) CheckIfFlush() error {
+	kv.flushMu.Lock()
+	defer kv.flushMu.Unlock()
 
-	// append ss to memSST
-	if kv.sstM.sstCount <= uint64(len(kv.sstM.memSST)) {
-		kv.sstM.memSST[kv.sstM.sstCount-1] = *ss
-	} else {
-		kv.sstM.memSST = append(kv.sstM.memSST, *ss)
+	if kv.flushing || !kv.memtableFull() {
+		return nil
 	}
 
-	return nil
-	// Show the size of each SST file in memory.
-}
+	fmt.Println("Need to flush!")
+	// From now on, the records are written to a new main memory and a new WAL segment.
+	old, maxSeq, err := kv.memDB.freeze()
+	if err != nil {
+		fmt.Print(err.Error())
+		return err
+	}
+	kv.flushing = true
+	kv.flushes.Add(1)
 
-func (kv *MyKvStore) CheckIfFlush() error {
-	// Check if the number of records in the main memory is greater than the threshold.
+	go func() {
+		defer kv.flushes.Done()
+		err := kv.FlushToSST(old, maxSeq)
 
-	if uint64(kv.memDB.store.Len()) > kv.sstM.loadThreshold {
-		// Flush the main memory to SST files.
-		fmt.Println("Need to flush!")
-		err := kv.FlushToSST()
+		kv.flushMu.Lock()
+		kv.flushing = false
+		kv.flushMu.Unlock()
 		if err != nil {
-			fmt.Print(err.Error())
-			return err
+			// The next write tries again.
+			fmt.Println("Error while flushing:", err)
+			return
 		}
 		fmt.Println("Flushed!")
-	}
+		// The main memory may have been filled during the flush.
+		kv.CheckIfFlush()
+	}()
 	return nil
 }
 
 func (kv *MyKvStore) Stop() error {
 	// Flush the main memory to SST files.
 	fmt.Println("Stopping the rwina...")
-	err := kv.memDB.Close()
-	if err != nil {
-		return err
-	}
 
-	err = kv.SSTCompaction()
+	// The flush in progress is done first, the main memory left is replayed from the WAL on the next start.
+	kv.flushMu.Lock()
+	kv.flushing = true
+	kv.flushMu.Unlock()
+	kv.flushes.Wait()
+
+	// The compactions in progress are canceled.
+	kv.sstM.stopCompactions()
+
+	err := kv.memDB.Close()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return kv.sstM.manifest.Close()
 }
 
 func (kv *MyKvStore) Get(key string) (string, error) {
+	return kv.get(key, latestSeq)
+}
+
+// get reads the newest record of the key whose sequence number is not after seq, latestSeq reads at the last write applied (see
+// Snapshot.go).
+func (kv *MyKvStore) get(key string, seq uint64) (string, error) {
 
 	// First look in the main memory.
 	// If not found, look in the SST files.
 	// If not found, return error.
 
-	// GetM Returns an error only if the key isn't in the memDB at all.
-	T, err := kv.memDB.GetM(key)
+	// The files are kept while the main memory is searched : no flush or compaction ends in between, and every record of the files
+	// is older than the last write applied.
+	kv.sstM.mu.RLock()
+	defer kv.sstM.mu.RUnlock()
+	if seq == latestSeq {
+		seq = kv.memDB.lastSeq()
+	}
+
+	T, found := kv.memDB.getAt(key, seq)
 
-	if err == nil {
+	if found && T.operation != string(Merge) {
 		// This means that we have the key with the corresponding value in our memDB.
 		// If the operation is delete, return error.
 		if T.operation == "del" {
-			return "", errors.New("Key Deleted")
+			return "", ErrKeyDeleted
+		}
+		// An expired value is read as a missing key.
+		if T.expired(time.Now().UnixNano()) {
+			return "", ErrKeyNotFound
 		}
 		return T.value, nil
-	} else {
+	}
 
-		// First look in the SST files.
-		//fmt.Println("Key not found in main memory, looking in SST files")
-		val, err := kv.sstM.Search(key)
-		//fmt.Println("Process finished")
-		if err != nil {
-			return "", err
-		}
-		return val, nil
+	// The newest records of the key are merge operands, the older ones are read down to its value (see Merge.go).
+	v := newMergeValue()
+	if found && !kv.memDB.readAt(key, seq, v.add) {
+		return v.result(kv.sstM.mergeOp, key)
+	}
+
+	// First look in the SST files.
+	//fmt.Println("Key not found in main memory, looking in SST files")
+	val, err := kv.sstM.searchFrom(key, seq, v)
+	//fmt.Println("Process finished")
+	if err != nil {
+		return "", err
 	}
+	return val, nil
 }
 
 func (kv *MyKvStore) Set(key string, val string) error {
@@ -305,17 +421,22 @@ func (kv *MyKvStore) Set(key string, val string) error {
 	return nil
 }
 
-func (kv *MyKvStore) Del(key string) (string, error) {
+// SetWithTTL writes the value of the key, it is read as missing once ttl has passed and dropped by the compactions afterwards.
+func (kv *MyKvStore) SetWithTTL(key string, val string, ttl time.Duration) error {
 	defer kv.CheckIfFlush()
+	return kv.memDB.SetExpiringM(key, val, time.Now().Add(ttl).UnixNano())
+}
 
-	s, err := kv.Get(key)
-	if err != nil {
-		return "", err
-	}
+func (kv *MyKvStore) Del(key string) (string, error) {
+	defer kv.CheckIfFlush()
 
-	//fmt.Println("Key found in main memory, deleting...")
-	// This means that we have the key with the corresponding value in our dataBase.
-	err1 := kv.memDB.DelM1(key)
+	// The key is looked up by the commit leader, so that no write of the key comes between the lookup and the deletion.
+	var s string
+	err1 := kv.memDB.DelIf(key, func() error {
+		var err error
+		s, err = kv.Get(key)
+		return err
+	})
 
 	fmt.Println("Ennnnnd")
 
@@ -326,39 +447,3 @@ func (kv *MyKvStore) Del(key string) (string, error) {
 	return s, nil
 
 }
-
-func (kv *MyKvStore) SSTCompaction() error {
-	n, err := CheckAndClean()
-
-	if err != nil {
-		return err
-	}
-	for n > mergeThreshold {
-
-		for i := uint64(0); i+1 < n; i += 2 {
-			fmt.Printf("Merging SST%d and SST%d\n", i, i+1)
-			err := kv.sstM.MergeSST(i, i+1)
-			if err != nil {
-				fmt.Println(err.Error())
-				return err
-			}
-		}
-
-		// If the number of SST files is odd, we need to rename the last SST file.
-		if n%2 == 1 {
-			fmt.Printf("Renaming SST%d to SST%d\n", n-1, n/2)
-			err := os.Rename(fmt.Sprintf("%s/SST%d.sst", directory, n-1), fmt.Sprintf("%s/SST%d.sst", directory, n/2))
-			if err != nil {
-				return err
-			}
-			//kv.sstM.sstCount = kv.sstM.sstCount / 2
-		}
-		n, err = CheckAndClean()
-		if err != nil {
-			return err
-		}
-
-	}
-
-	return nil
-}
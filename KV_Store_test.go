@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemtableFlushThreshold(t *testing.T) {
+	chdirTemp(t)
+	opts := DefaultOptions()
+	opts.MemtableSize = 64 << 10
+	opts.MaxBackgroundCompactions = 0
+	kv, err := NewKeyValueStoreWithOptions(opts)
+	assert.NoError(t, err)
+	assert.NoError(t, kv.Start())
+	defer kv.Stop()
+
+	// Many small records stay in the main memory.
+	for i := 0; i < 400; i++ {
+		assert.NoError(t, kv.Set(fmt.Sprintf("Small_%03d", i), "v"))
+	}
+	kv.flushes.Wait()
+	assert.Empty(t, kv.sstM.metas())
+	assert.Equal(t, 400, kv.memDB.Len())
+
+	// A few large records fill it.
+	value := strings.Repeat("v", 16<<10)
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, kv.Set(fmt.Sprintf("Large_%d", i), value))
+	}
+	kv.flushes.Wait()
+	assert.Equal(t, 1, len(kv.sstM.metas()))
+	assert.Less(t, kv.memDB.Size(), opts.MemtableSize)
+
+	val, err := kv.Get("Large_3")
+	assert.NoError(t, err)
+	assert.Equal(t, value, val)
+	val, err = kv.Get("Small_100")
+	assert.NoError(t, err)
+	assert.Equal(t, "v", val)
+}
+
+func TestFailedFlushRemovesSST(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+	assert.NoError(t, kv.Set("a", "1"))
+
+	// The MANIFEST can't record the file written.
+	old, seq, err := kv.memDB.freeze()
+	assert.NoError(t, err)
+	assert.NoError(t, kv.sstM.manifest.log.Close())
+	assert.Error(t, kv.FlushToSST(old, seq))
+
+	num := kv.sstM.manifest.newFileNumber() - 1
+	_, err = os.Stat(sstFileName(directory, num))
+	assert.True(t, os.IsNotExist(err))
+	v, err := kv.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", v)
+}
+
+// openTestStore opens a store in a temporary directory, with a small main memory so that the flushes and the compactions run
+// during the test.
+func openTestStore(t *testing.T) *MyKvStore {
+	chdirTemp(t)
+	opts := DefaultOptions()
+	opts.MemtableSize = 32 << 10
+	opts.MaxBackgroundCompactions = 2
+	kv, err := NewKeyValueStoreWithOptions(opts)
+	assert.NoError(t, err)
+	assert.NoError(t, kv.Start())
+	return kv
+}
+
+func TestConcurrentStress(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+
+	const writers, readers, keys, rounds = 4, 4, 150, 8
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// Each writer owns its keys, and writes increasing versions of them. Every third key is deleted at the end of a round.
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 1; r <= rounds; r++ {
+				for k := 0; k < keys; k++ {
+					assert.NoError(t, kv.Set(fmt.Sprintf("Key_%d_%03d", w, k), fmt.Sprintf("%04d", r)))
+				}
+				for k := 0; k < keys; k += 3 {
+					_, err := kv.Del(fmt.Sprintf("Key_%d_%03d", w, k))
+					assert.NoError(t, err)
+				}
+			}
+		}(w)
+	}
+
+	// A reader never sees a version older than one it has seen.
+	var rwg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		rwg.Add(1)
+		go func(r int) {
+			defer rwg.Done()
+			seen := make(map[string]string)
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := fmt.Sprintf("Key_%d_%03d", i%writers, (i*7+r)%keys)
+				val, err := kv.Get(key)
+				if err != nil {
+					assert.Contains(t, []string{"Key Not Found", "Key Deleted"}, err.Error())
+					continue
+				}
+				assert.GreaterOrEqual(t, val, seen[key], key)
+				seen[key] = val
+			}
+		}(r)
+	}
+
+	wg.Wait()
+	close(done)
+	rwg.Wait()
+
+	// The flushes and the compactions in progress are done.
+	kv.flushes.Wait()
+	for w := 0; w < writers; w++ {
+		for k := 0; k < keys; k++ {
+			val, err := kv.Get(fmt.Sprintf("Key_%d_%03d", w, k))
+			if k%3 == 0 {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("%04d", rounds), val)
+			}
+		}
+	}
+	assert.NotEmpty(t, kv.sstM.metas())
+}
+
+func TestConcurrentHTTP(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+	api := &HTTP_API_DB{db: kv}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", api.HandleGet)
+	mux.HandleFunc("/set", api.HandleSet)
+	mux.HandleFunc("/del", api.HandleDel)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	post := func(path string) (int, string) {
+		resp, err := http.Post(server.URL+path, "", nil)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("Key_%d_%d", c, i)
+				value := strings.Repeat("v", 100)
+				code, _ := post("/set?key=" + key + "&value=" + value)
+				assert.Equal(t, http.StatusNoContent, code)
+				_, body := post("/get?key=" + key)
+				assert.Equal(t, value, body)
+				if i%2 == 0 {
+					_, body = post("/del?key=" + key)
+					assert.Equal(t, value, body)
+					code, body = post("/get?key=" + key)
+					assert.Equal(t, http.StatusOK, code)
+					assert.Equal(t, "Key not found", body)
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	// A key never written is not found either.
+	code, body := post("/get?key=Missing")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "Key not found", body)
+}
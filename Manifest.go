@@ -0,0 +1,353 @@
+package main
+
+// The MANIFEST lists the live SST files, so that the file set never depends on what is found in the SST directory.
+// It is a log of version edits : each edit adds and deletes SST files, replaying the edits in order gives the current file set.
+// An edit is written as JSON, framed like a WAL record (see WAL.go), so a torn edit at the end of the MANIFEST is dropped like a
+// torn WAL record.
+
+// When the store is opened, and when the MANIFEST grows over maxManifestSize, a new MANIFEST-<n> is written with a single edit
+// holding the whole file set. Once it is synced, the CURRENT file (which holds the name of the MANIFEST in use) is replaced with a
+// rename, then the old MANIFEST is deleted. A crash at any step leaves CURRENT naming a complete MANIFEST, the other MANIFEST files
+// left by a crash are deleted on the next open.
+
+// An SST file is added to the MANIFEST once it is synced and renamed, and deleted from the disk once the edit removing it is synced.
+// The SST files of the directory missing from the MANIFEST are orphans (a file written just before a crash, its records are still in
+// the WAL segments or in the merged files), they are reported on startup and never read.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const maxManifestSize int64 = 4 << 20
+const currentName string = "CURRENT"
+
+// fileMeta : The description of an SST file recorded in the MANIFEST.
+type fileMeta struct {
+	Num   uint64
+	Level int
+	// Smallest and largest keys of the file.
+	Smallest string
+	Largest  string
+	Size     int64
+	// Sequence number of the newest record of the file.
+	MaxSeq uint64
+}
+
+// versionEdit : A change of the file set, the counters left to 0 are unchanged.
+type versionEdit struct {
+	Added   []fileMeta `json:",omitempty"`
+	Deleted []uint64   `json:",omitempty"`
+	// Number of the next SST file.
+	NextFile uint64 `json:",omitempty"`
+	// Sequence number of the newest record written to an SST file.
+	LastSeq uint64 `json:",omitempty"`
+	// The WAL segments numbered below LogNum are in the SST files (see TreeMap.go).
+	LogNum uint64 `json:",omitempty"`
+	// Name of the merge operator of the store (see Merge.go).
+	MergeOperator string `json:",omitempty"`
+}
+
+type manifest struct {
+	// Protects the counters and the MANIFEST file, the compactions take file numbers while an edit is written.
+	mu  sync.Mutex
+	dir string
+	// Number of the MANIFEST in use.
+	num uint64
+	log *WALFile
+
+	files    map[uint64]fileMeta
+	nextFile uint64
+	lastSeq  uint64
+	logNum   uint64
+	mergeOp  string
+}
+
+func manifestName(dir string, num uint64) string {
+	return fmt.Sprintf("%s/MANIFEST-%d", dir, num)
+}
+
+// openManifest rebuilds the file set from the MANIFEST named by CURRENT, and starts a new MANIFEST.
+// Without CURRENT, the SST files found in the directory (written before the MANIFEST, numbered in the order they were written)
+// become the file set.
+func openManifest(dir string, found []uint64) (*manifest, error) {
+	mf := &manifest{dir: dir, files: make(map[uint64]fileMeta)}
+
+	current, err := os.ReadFile(dir + "/" + currentName)
+	switch {
+	case os.IsNotExist(err):
+		if err := mf.adoptFiles(found); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		name := strings.TrimSuffix(string(current), "\n")
+		if _, err := fmt.Sscanf(name, "MANIFEST-%d", &mf.num); err != nil || name != fmt.Sprintf("MANIFEST-%d", mf.num) {
+			return nil, &ErrCorruption{File: dir + "/" + currentName, Offset: 0, Reason: "invalid MANIFEST name"}
+		}
+		if err := mf.replay(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mf.rollover(); err != nil {
+		return nil, err
+	}
+	if err := mf.removeStale(); err != nil {
+		mf.Close()
+		return nil, err
+	}
+	return mf, nil
+}
+
+// removeStale deletes the MANIFEST files other than the one in use.
+func (mf *manifest) removeStale() error {
+	entries, err := os.ReadDir(mf.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		var num uint64
+		if _, err := fmt.Sscanf(entry.Name(), "MANIFEST-%d", &num); err != nil || entry.Name() != fmt.Sprintf("MANIFEST-%d", num) {
+			continue
+		}
+		if num != mf.num {
+			if err := os.Remove(manifestName(mf.dir, num)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// adoptFiles records the SST files written before the MANIFEST, their numbers give their order.
+func (mf *manifest) adoptFiles(found []uint64) error {
+	for i, num := range found {
+		meta, err := readFileMeta(mf.dir, num)
+		if err != nil {
+			return err
+		}
+		// There were no sequence numbers, keep the order of the files.
+		meta.MaxSeq = uint64(i + 1)
+		mf.files[num] = meta
+		mf.nextFile = num + 1
+	}
+	mf.lastSeq = uint64(len(found))
+	return nil
+}
+
+// readFileMeta reads the key range and the size of an SST file.
+func readFileMeta(dir string, num uint64) (fileMeta, error) {
+	file, err := os.Open(sstFileName(dir, num))
+	if err != nil {
+		return fileMeta{}, err
+	}
+	defer file.Close()
+
+	table, err := openSSTTable(file)
+	if err != nil {
+		return fileMeta{}, err
+	}
+	meta := fileMeta{Num: num, Size: table.size}
+	it := table.newIterator()
+	for i := 0; ; i++ {
+		record, err := it.next()
+		if err == io.EOF {
+			return meta, nil
+		}
+		if err != nil {
+			return fileMeta{}, err
+		}
+		if i == 0 {
+			meta.Smallest = record.Key
+		}
+		meta.Largest = record.Key
+	}
+}
+
+// replay applies the edits of the MANIFEST in use.
+func (mf *manifest) replay() error {
+	name := manifestName(mf.dir, mf.num)
+	if _, err := os.Stat(name); err != nil {
+		if os.IsNotExist(err) {
+			return &ErrCorruption{File: name, Offset: 0, Reason: "MANIFEST named by CURRENT is missing"}
+		}
+		return err
+	}
+	log, err := NewWALFile(name)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	if log.legacy {
+		return &ErrCorruption{File: name, Offset: 0, Reason: "bad MANIFEST magic number"}
+	}
+
+	if err := log.SeekStart(); err != nil {
+		return err
+	}
+	for {
+		data, end, err := log.readFrame()
+		if err == io.EOF {
+			return nil
+		}
+		// The edit was being written during a crash, it was never applied.
+		if err == errTornRecord {
+			fmt.Printf("Dropped a torn edit at the end of %s\n", name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var edit versionEdit
+		if err := json.Unmarshal(data, &edit); err != nil {
+			return &ErrCorruption{File: name, Offset: log.pos, Reason: "undecodable MANIFEST edit"}
+		}
+		mf.apply(edit)
+		log.pos = end
+	}
+}
+
+func (mf *manifest) apply(edit versionEdit) {
+	for _, num := range edit.Deleted {
+		delete(mf.files, num)
+	}
+	for _, meta := range edit.Added {
+		mf.files[meta.Num] = meta
+	}
+	mf.nextFile = max(mf.nextFile, edit.NextFile)
+	mf.lastSeq = max(mf.lastSeq, edit.LastSeq)
+	mf.logNum = max(mf.logNum, edit.LogNum)
+	if edit.MergeOperator != "" {
+		mf.mergeOp = edit.MergeOperator
+	}
+}
+
+// logAndApply appends the edit to the MANIFEST and syncs it, then applies it to the file set.
+func (mf *manifest) logAndApply(edit versionEdit) error {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	edit.NextFile = mf.nextFile
+	js, err := json.Marshal(edit)
+	if err != nil {
+		return err
+	}
+	// The MANIFEST is synced on every write (see NewWALFile).
+	if err := mf.log.writeFrames(appendWalFrame(nil, js)); err != nil {
+		return err
+	}
+	mf.apply(edit)
+
+	if mf.log.written.Load() > maxManifestSize {
+		return mf.rollover()
+	}
+	return nil
+}
+
+// rollover writes the whole file set to a new MANIFEST, makes CURRENT name it, and deletes the old one.
+func (mf *manifest) rollover() error {
+	num := mf.num + 1
+	name := manifestName(mf.dir, num)
+
+	// A MANIFEST left by a crash during a previous rollover was never named by CURRENT.
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log, err := NewWALFile(name)
+	if err != nil {
+		return err
+	}
+	snapshot := versionEdit{Added: mf.sortedFiles(), NextFile: mf.nextFile, LastSeq: mf.lastSeq, LogNum: mf.logNum, MergeOperator: mf.mergeOp}
+	js, err := json.Marshal(snapshot)
+	if err == nil {
+		err = log.writeFrames(appendWalFrame(nil, js))
+	}
+	if err == nil {
+		err = setCurrent(mf.dir, num)
+	}
+	if err != nil {
+		log.Close()
+		return err
+	}
+
+	if mf.log != nil {
+		mf.log.Close()
+	}
+	if err := os.Remove(manifestName(mf.dir, mf.num)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	mf.log = log
+	mf.num = num
+	return nil
+}
+
+// setCurrent makes CURRENT name the MANIFEST num, with a rename so that CURRENT is never partially written.
+func setCurrent(dir string, num uint64) error {
+	tmp := dir + "/" + currentName + ext
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "MANIFEST-%d\n", num); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	file.Close()
+
+	if err := os.Rename(tmp, dir+"/"+currentName); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// newFileNumber returns the number of a new SST file, it is recorded by the next edit.
+func (mf *manifest) newFileNumber() uint64 {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	num := mf.nextFile
+	mf.nextFile++
+	return num
+}
+
+// recorded reports whether the SST file num is in the file set.
+func (mf *manifest) recorded(num uint64) bool {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	_, ok := mf.files[num]
+	return ok
+}
+
+// sortedFiles returns the live SST files, from the oldest to the newest (see fileLess).
+func (mf *manifest) sortedFiles() []fileMeta {
+	files := make([]fileMeta, 0, len(mf.files))
+	for _, meta := range mf.files {
+		files = append(files, meta)
+	}
+	sort.Slice(files, func(i, j int) bool { return fileLess(files[i], files[j]) })
+	return files
+}
+
+// orphans returns the SST files found in the directory that are not in the file set.
+func (mf *manifest) orphans(found []uint64) []uint64 {
+	var nums []uint64
+	for _, num := range found {
+		if _, ok := mf.files[num]; !ok {
+			nums = append(nums, num)
+		}
+	}
+	return nums
+}
+
+func (mf *manifest) Close() error {
+	return mf.log.Close()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestSSTFile writes the records to the SST file num of dir, and returns its description.
+func writeTestSSTFile(t *testing.T, dir string, num uint64, records []FileRecord) fileMeta {
+	file, err := os.Create(sstFileName(dir, num))
+	assert.NoError(t, err)
+	defer file.Close()
+
+	w, err := newSSTWriter(file, DefaultOptions().BloomBitsPerKey)
+	assert.NoError(t, err)
+	for _, r := range records {
+		assert.NoError(t, w.add(r))
+	}
+	assert.NoError(t, w.finish())
+	return w.fileMeta(num, 0)
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	mf, err := openManifest(dir, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, mf.files)
+
+	// Add three files, then replace the two oldest ones.
+	for i := 0; i < 3; i++ {
+		num := mf.newFileNumber()
+		meta := fileMeta{Num: num, Smallest: "a", Largest: "z", Size: 100, MaxSeq: uint64(10 * (i + 1))}
+		assert.NoError(t, mf.logAndApply(versionEdit{Added: []fileMeta{meta}, LastSeq: meta.MaxSeq, LogNum: num + 1}))
+	}
+	merged := fileMeta{Num: mf.newFileNumber(), Smallest: "a", Largest: "z", Size: 200, MaxSeq: 20}
+	assert.NoError(t, mf.logAndApply(versionEdit{Added: []fileMeta{merged}, Deleted: []uint64{0, 1}}))
+	assert.NoError(t, mf.Close())
+
+	// The file set is rebuilt from the MANIFEST named by CURRENT.
+	current, err := os.ReadFile(dir + "/" + currentName)
+	assert.NoError(t, err)
+	assert.Equal(t, "MANIFEST-1\n", string(current))
+
+	mf, err = openManifest(dir, []uint64{2, 3})
+	assert.NoError(t, err)
+	defer mf.Close()
+	files := mf.sortedFiles()
+	assert.Equal(t, 2, len(files))
+	assert.Equal(t, merged, files[0])
+	assert.Equal(t, uint64(2), files[1].Num)
+	assert.Equal(t, uint64(4), mf.nextFile)
+	assert.Equal(t, uint64(30), mf.lastSeq)
+	assert.Equal(t, uint64(3), mf.logNum)
+
+	// The new MANIFEST replaced the old one.
+	current, err = os.ReadFile(dir + "/" + currentName)
+	assert.NoError(t, err)
+	assert.Equal(t, "MANIFEST-2\n", string(current))
+	_, err = os.Stat(manifestName(dir, 1))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestManifestTornEdit(t *testing.T) {
+	dir := t.TempDir()
+	mf, err := openManifest(dir, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, mf.logAndApply(versionEdit{Added: []fileMeta{{Num: mf.newFileNumber(), MaxSeq: 1}}}))
+	assert.NoError(t, mf.logAndApply(versionEdit{Added: []fileMeta{{Num: mf.newFileNumber(), MaxSeq: 2}}}))
+
+	// Cut the last edit.
+	size, err := mf.log.size()
+	assert.NoError(t, err)
+	assert.NoError(t, mf.log.file.Truncate(size-5))
+	assert.NoError(t, mf.Close())
+
+	mf, err = openManifest(dir, nil)
+	assert.NoError(t, err)
+	defer mf.Close()
+	assert.Equal(t, 1, len(mf.files))
+	assert.Equal(t, uint64(0), mf.sortedFiles()[0].Num)
+}
+
+func TestManifestStaleFiles(t *testing.T) {
+	dir := t.TempDir()
+	mf, err := openManifest(dir, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, mf.Close())
+
+	// A crash after CURRENT was replaced left the old MANIFEST.
+	data, err := os.ReadFile(manifestName(dir, 1))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(manifestName(dir, 0), data, 0644))
+
+	mf, err = openManifest(dir, nil)
+	assert.NoError(t, err)
+	defer mf.Close()
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{currentName, "MANIFEST-2"}, names)
+}
+
+func TestManifestAdoptFilesAndOrphans(t *testing.T) {
+	dir := t.TempDir()
+
+	// SST files written before the MANIFEST.
+	var metas []fileMeta
+	for i := 0; i < 3; i++ {
+		var records []FileRecord
+		for j := 0; j < 10; j++ {
+			records = append(records, FileRecord{Operation: "set", Key: fmt.Sprintf("Key_%d_%d", i, j), Value: "Value"})
+		}
+		metas = append(metas, writeTestSSTFile(t, dir, uint64(i), records))
+	}
+
+	mf, err := openManifest(dir, []uint64{0, 1, 2})
+	assert.NoError(t, err)
+	defer mf.Close()
+	files := mf.sortedFiles()
+	assert.Equal(t, 3, len(files))
+	for i, meta := range files {
+		// The order of the files is kept.
+		metas[i].MaxSeq = uint64(i + 1)
+		assert.Equal(t, metas[i], meta)
+	}
+	assert.Equal(t, uint64(3), mf.nextFile)
+
+	// A file missing from the MANIFEST is an orphan.
+	writeTestSSTFile(t, dir, 7, nil)
+	assert.Equal(t, []uint64{7}, mf.orphans([]uint64{0, 1, 2, 7}))
+}
+
+func TestManifestMissing(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dir+"/"+currentName, []byte("MANIFEST-4\n"), 0644))
+	_, err := openManifest(dir, nil)
+	var corrupt *ErrCorruption
+	assert.ErrorAs(t, err, &corrupt)
+}
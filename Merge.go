@@ -0,0 +1,259 @@
+package main
+
+// A merge writes an operand for a key instead of its value (a "merge" record) : the merge operator of the store (see
+// Options.MergeOperator) folds the operands into the value of the key when it is read. A read goes through the records of the key
+// from the newest to the oldest, collecting the operands until it meets a value or a deletion, then folds them from the oldest to the
+// newest on that value (or on no value).
+
+// The flushes and the compactions fold the operands as well, into a single value written with the sequence number of the newest
+// operand, when they hold the record under them and no snapshot reads the records in between (see keptRecords). Otherwise the
+// operands are written as they are, and a merge record never hides the older records of its key.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// MergeOperator : Folds the merge operands of a key into its value. It must give the same value for the same operands, whenever it
+// is called : the operands may be folded by a read, a flush or a compaction.
+type MergeOperator interface {
+	// Name identifies the operator, it is recorded in the MANIFEST.
+	Name() string
+	// Merge returns the value of the key once the operands (from the oldest to the newest) are applied to value. exists is false
+	// if the key had no value before the operands (it was missing, deleted or expired).
+	Merge(key string, value string, exists bool, operands []string) (string, error)
+}
+
+var errNoMergeOperator = errors.New("no merge operator")
+
+// ErrMergeOperatorMismatch : The store is opened without the merge operator recorded in its MANIFEST, or with another one.
+var ErrMergeOperatorMismatch = errors.New("Merge Operator Mismatch")
+
+// Int64AddOperator returns the operator of the counters : the value and the operands are int64 in base 10, added together.
+func Int64AddOperator() MergeOperator {
+	return int64Add{}
+}
+
+type int64Add struct{}
+
+func (int64Add) Name() string {
+	return "int64-add"
+}
+
+func (int64Add) Merge(key string, value string, exists bool, operands []string) (string, error) {
+	var sum int64
+	if exists {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", err
+		}
+		sum = n
+	}
+	for _, operand := range operands {
+		n, err := strconv.ParseInt(operand, 10, 64)
+		if err != nil {
+			return "", err
+		}
+		sum += n
+	}
+	return strconv.FormatInt(sum, 10), nil
+}
+
+// StringAppendOperator returns the operator appending the operands to the value, separated by sep.
+func StringAppendOperator(sep string) MergeOperator {
+	return stringAppend{sep: sep}
+}
+
+type stringAppend struct {
+	sep string
+}
+
+func (stringAppend) Name() string {
+	return "string-append"
+}
+
+func (o stringAppend) Merge(key string, value string, exists bool, operands []string) (string, error) {
+	for i, operand := range operands {
+		if exists || i > 0 {
+			value += o.sep
+		}
+		value += operand
+	}
+	return value, nil
+}
+
+// setMergeOperator sets the merge operator of the store. Its name is recorded in the MANIFEST by the first open that gives one, the
+// next opens must give an operator of the same name : the operands already written would be folded differently, or not at all.
+func (m *mySSTManager) setMergeOperator(op MergeOperator) error {
+	recorded := m.manifest.mergeOp
+	switch {
+	case op == nil && recorded != "":
+		return fmt.Errorf("%w : the store uses %q", ErrMergeOperatorMismatch, recorded)
+	case op != nil && recorded != "" && op.Name() != recorded:
+		return fmt.Errorf("%w : the store uses %q, not %q", ErrMergeOperatorMismatch, recorded, op.Name())
+	case op != nil && recorded == "":
+		if err := m.manifest.logAndApply(versionEdit{MergeOperator: op.Name()}); err != nil {
+			return err
+		}
+	}
+	m.mergeOp = op
+	return nil
+}
+
+// MergeM writes the merge operand of the key through the group commit (see GroupCommit.go).
+func (s *PersMem) MergeM(key string, operand string) error {
+	r := FileRecord{
+		Operation: Merge,
+		Key:       key,
+		Value:     operand,
+	}
+	records := []FileRecord{r}
+	return s.commit(records, func() error {
+		tp := Tuple{string(Merge), operand, 0}
+		s.store.Set(key, tp, records[0].Seq)
+		return nil
+	})
+}
+
+// Merge writes an operand of the key, folded into its value by the merge operator of the store.
+func (kv *MyKvStore) Merge(key string, operand string) error {
+	if kv.sstM.mergeOp == nil {
+		return errNoMergeOperator
+	}
+	defer kv.CheckIfFlush()
+	return kv.memDB.MergeM(key, operand)
+}
+
+// mergeValue : The records of a key read from the newest to the oldest, until its value is known.
+type mergeValue struct {
+	now int64
+	// The operands met, from the newest to the oldest.
+	operands []string
+	// The value or the deletion under the operands.
+	base  FileRecord
+	found bool
+}
+
+func newMergeValue() *mergeValue {
+	return &mergeValue{now: time.Now().UnixNano()}
+}
+
+// add adds the next older record of the key, it returns false once the value is known.
+func (v *mergeValue) add(record FileRecord) bool {
+	if record.Operation == Merge {
+		v.operands = append(v.operands, record.Value)
+		return true
+	}
+	v.base, v.found = record, true
+	return false
+}
+
+// value returns the value of the key, the second value is false if it has none.
+func (v *mergeValue) value(op MergeOperator, key string) (string, bool, error) {
+	base, exists := baseValue(v.base, v.now)
+	if len(v.operands) == 0 {
+		return base, exists, nil
+	}
+	if op == nil {
+		return "", false, errNoMergeOperator
+	}
+	val, err := op.Merge(key, base, exists, reverseStrings(v.operands))
+	return val, err == nil, err
+}
+
+// result returns the value of the key as Get does.
+func (v *mergeValue) result(op MergeOperator, key string) (string, error) {
+	val, exists, err := v.value(op, key)
+	switch {
+	case err != nil:
+		return "", err
+	case exists:
+		return val, nil
+	// A deletion with an expiry was an expired value (see Compaction.go), the key is missing.
+	case v.found && v.base.Operation == Del && v.base.Expiry == 0 && len(v.operands) == 0:
+		return "", ErrKeyDeleted
+	}
+	return "", ErrKeyNotFound
+}
+
+// baseValue returns the value the operands are folded on, the second value is false if the record holds none (it is a deletion, an
+// expired value or no record).
+func baseValue(base FileRecord, now int64) (string, bool) {
+	if base.Operation != Put || base.expired(now) {
+		return "", false
+	}
+	return base.Value, true
+}
+
+func reverseStrings(s []string) []string {
+	r := make([]string, len(s))
+	for i, x := range s {
+		r[len(s)-1-i] = x
+	}
+	return r
+}
+
+// keptRecords returns the records of a key that a flush or a compaction writes, given and returned from the newest to the oldest :
+// the newest record, the older ones read by a snapshot, and the ones under merge operands that could not be folded. bottom reports
+// whether no older record of the key may exist besides the given ones. It also returns the number of records folded into the
+// operands above them.
+func keptRecords(records []FileRecord, snapshots []uint64, now int64, op MergeOperator, bottom func(key string) bool) ([]FileRecord, int) {
+	var kept []FileRecord
+	folded := 0
+	// The sequence number of the newer record that hides the older ones, a merge operand hides nothing.
+	newer := latestSeq
+	for i := 0; i < len(records); i++ {
+		record := records[i]
+		if !keepRecord(record.Seq, newer, snapshots) {
+			continue
+		}
+		if record.Operation == Merge && op != nil {
+			if merged, n, ok := foldOperands(records[i:], snapshots, now, op, bottom); ok {
+				record = merged
+				folded += n
+				i += n
+			}
+		}
+		kept = append(kept, record)
+		if record.Operation != Merge {
+			newer = record.Seq
+		}
+	}
+	return kept, folded
+}
+
+// foldOperands folds the merge operand records[0] with the older records of the key, down to the first value or deletion (or down
+// to the oldest record if bottom is true for the key). It returns the value written in their place and the number of older records
+// folded, false when a snapshot reads one of them, when the operator fails (the reads return its error) or when no value was met.
+// A value that expires later is not folded either : the reads fold the operands on it until it expires, and on no value afterwards.
+func foldOperands(records []FileRecord, snapshots []uint64, now int64, op MergeOperator, bottom func(key string) bool) (FileRecord, int, bool) {
+	operands := []string{records[0].Value}
+	var base FileRecord
+	n := 0
+	for j := 1; j < len(records); j++ {
+		if keepRecord(records[j].Seq, records[j-1].Seq, snapshots) {
+			return FileRecord{}, 0, false
+		}
+		n = j
+		if records[j].Operation != Merge {
+			base = records[j]
+			break
+		}
+		operands = append(operands, records[j].Value)
+	}
+	if base.Operation == "" && !bottom(records[0].Key) {
+		return FileRecord{}, 0, false
+	}
+	if base.Expiry != 0 && !base.expired(now) {
+		return FileRecord{}, 0, false
+	}
+
+	value, exists := baseValue(base, now)
+	val, err := op.Merge(records[0].Key, value, exists, reverseStrings(operands))
+	if err != nil {
+		return FileRecord{}, 0, false
+	}
+	return FileRecord{Operation: Put, Key: records[0].Key, Value: val, Seq: records[0].Seq}, n, true
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// openMergeTestStore opens a store as openTestStore does, with the merge operator op.
+func openMergeTestStore(t *testing.T, op MergeOperator) *MyKvStore {
+	chdirTemp(t)
+	opts := DefaultOptions()
+	opts.MemtableSize = 32 << 10
+	opts.MaxBackgroundCompactions = 2
+	opts.MergeOperator = op
+	kv, err := NewKeyValueStoreWithOptions(opts)
+	assert.NoError(t, err)
+	assert.NoError(t, kv.Start())
+	return kv
+}
+
+func TestMergeOperators(t *testing.T) {
+	add := Int64AddOperator()
+	v, err := add.Merge("k", "10", true, []string{"1", "-3"})
+	assert.NoError(t, err)
+	assert.Equal(t, "8", v)
+	v, err = add.Merge("k", "", false, []string{"2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "2", v)
+	_, err = add.Merge("k", "ten", true, []string{"1"})
+	assert.Error(t, err)
+
+	app := StringAppendOperator(",")
+	v, err = app.Merge("k", "a", true, []string{"b", "c"})
+	assert.NoError(t, err)
+	assert.Equal(t, "a,b,c", v)
+	v, err = app.Merge("k", "", false, []string{"b", "c"})
+	assert.NoError(t, err)
+	assert.Equal(t, "b,c", v)
+}
+
+func TestMerge(t *testing.T) {
+	kv := openMergeTestStore(t, Int64AddOperator())
+	defer kv.Stop()
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, kv.Merge("a", "1"))
+	}
+	assert.NoError(t, kv.Set("b", "100"))
+	assert.NoError(t, kv.Merge("b", "-1"))
+	assert.NoError(t, kv.Set("c", "100"))
+	_, err := kv.Del("c")
+	assert.NoError(t, err)
+	assert.NoError(t, kv.Merge("c", "7"))
+	assert.NoError(t, kv.Set("d", "1"))
+	snap := kv.GetSnapshot()
+	defer snap.Release()
+	assert.NoError(t, kv.Merge("d", "1"))
+
+	check := func() {
+		for key, want := range map[string]string{"a": "5", "b": "99", "c": "7", "d": "2"} {
+			v, err := kv.Get(key)
+			assert.NoError(t, err)
+			assert.Equal(t, want, v, key)
+		}
+		v, err := snap.Get("d")
+		assert.NoError(t, err)
+		assert.Equal(t, "1", v)
+
+		var got []string
+		it, err := kv.NewIterator("a", "e")
+		assert.NoError(t, err)
+		for ; it.Valid(); it.Next() {
+			got = append(got, it.Key()+"="+it.Value())
+		}
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			got = append(got, it.Key()+"="+it.Value())
+		}
+		assert.NoError(t, it.Err())
+		it.Close()
+		assert.Equal(t, []string{"a=5", "b=99", "c=7", "d=2", "d=2", "c=7", "b=99", "a=5"}, got)
+	}
+	check()
+
+	// The operands are folded by the flushes and the compactions, or read across the files.
+	for i := 0; i < 3000; i++ {
+		assert.NoError(t, kv.Set(fmt.Sprintf("Filler_%04d", i), strings.Repeat("v", 100)))
+		if i%500 == 0 {
+			assert.NoError(t, kv.Merge("a", "1"))
+		}
+	}
+	assert.NoError(t, kv.Merge("a", "-6"))
+	kv.flushes.Wait()
+	waitCompactions(kv.sstM)
+	assert.Greater(t, len(kv.sstM.metas()), 1)
+	check()
+
+	// An operand the operator cannot parse is returned by the reads.
+	assert.NoError(t, kv.Merge("b", "x"))
+	_, err = kv.Get("b")
+	assert.Error(t, err)
+}
+
+func TestMergeCounter(t *testing.T) {
+	kv := openMergeTestStore(t, Int64AddOperator())
+	defer kv.Stop()
+
+	// Concurrent increments : none is lost.
+	const workers, increments = 4, 200
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				assert.NoError(t, kv.Merge("counter", "1"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := kv.Get("counter")
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprint(workers*increments), v)
+}
+
+func TestMergeReplay(t *testing.T) {
+	dir := t.TempDir()
+	mem := openTestPersMem(t, dir)
+	assert.NoError(t, mem.SetM("a", "1"))
+	assert.NoError(t, mem.MergeM("a", "2"))
+	mem.Close()
+
+	// The operands are kept in the WAL.
+	mem = openTestPersMem(t, dir)
+	assert.NoError(t, mem.Load())
+	v, err := mem.GetM("a")
+	assert.NoError(t, err)
+	assert.Equal(t, Tuple{"merge", "2", 0}, v)
+	assert.Equal(t, uint64(2), mem.seq)
+}
+
+func TestMergeWithoutOperator(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+	assert.ErrorIs(t, kv.Merge("a", "1"), errNoMergeOperator)
+}
+
+func TestMergeOperatorRecorded(t *testing.T) {
+	kv := openMergeTestStore(t, Int64AddOperator())
+	assert.NoError(t, kv.Merge("a", "1"))
+	assert.NoError(t, kv.Stop())
+
+	// The store must be opened again with an operator of the same name.
+	open := func(op MergeOperator) error {
+		opts := DefaultOptions()
+		opts.MergeOperator = op
+		kv, err := NewKeyValueStoreWithOptions(opts)
+		if err == nil {
+			assert.NoError(t, kv.Stop())
+		}
+		return err
+	}
+	assert.ErrorIs(t, open(StringAppendOperator(",")), ErrMergeOperatorMismatch)
+	assert.ErrorIs(t, open(nil), ErrMergeOperatorMismatch)
+	assert.NoError(t, open(Int64AddOperator()))
+}
+
+func TestKeptRecords(t *testing.T) {
+	op := StringAppendOperator(",")
+	never := func(string) bool { return false }
+	always := func(string) bool { return true }
+	records := []FileRecord{
+		{Operation: Merge, Key: "k", Value: "c", Seq: 9},
+		{Operation: Merge, Key: "k", Value: "b", Seq: 8},
+		{Operation: Put, Key: "k", Value: "a", Seq: 5},
+		{Operation: Put, Key: "k", Value: "old", Seq: 3},
+	}
+
+	// The operands are folded with the value under them, the older records are dropped.
+	kept, folded := keptRecords(records, nil, 0, op, never)
+	assert.Equal(t, []FileRecord{{Operation: Put, Key: "k", Value: "a,b,c", Seq: 9}}, kept)
+	assert.Equal(t, 2, folded)
+
+	// A snapshot at 8 reads b folded with a : the operands above it are kept as they are.
+	kept, folded = keptRecords(records, []uint64{8}, 0, op, never)
+	assert.Equal(t, []FileRecord{records[0], {Operation: Put, Key: "k", Value: "a,b", Seq: 8}}, kept)
+	assert.Equal(t, 1, folded)
+
+	// Without a value under them, the operands are folded only when no older file may hold the key.
+	kept, folded = keptRecords(records[:2], nil, 0, op, never)
+	assert.Equal(t, records[:2], kept)
+	assert.Equal(t, 0, folded)
+	kept, _ = keptRecords(records[:2], nil, 0, op, always)
+	assert.Equal(t, []FileRecord{{Operation: Put, Key: "k", Value: "b,c", Seq: 9}}, kept)
+
+	// A deletion under the operands is folded as no value.
+	deleted := []FileRecord{records[0], {Operation: Del, Key: "k", Seq: 6}, records[2]}
+	kept, _ = keptRecords(deleted, nil, 0, op, never)
+	assert.Equal(t, []FileRecord{{Operation: Put, Key: "k", Value: "c", Seq: 9}}, kept)
+
+	// A value that expires later is not folded, an expired one is folded as no value.
+	expiring := []FileRecord{records[0], {Operation: Put, Key: "k", Value: "a", Seq: 5, Expiry: 100}}
+	kept, _ = keptRecords(expiring, nil, 50, op, never)
+	assert.Equal(t, expiring, kept)
+	kept, _ = keptRecords(expiring, nil, 100, op, never)
+	assert.Equal(t, []FileRecord{{Operation: Put, Key: "k", Value: "c", Seq: 9}}, kept)
+}
+
+func TestMergeOnExpiringValue(t *testing.T) {
+	kv := openMergeTestStore(t, Int64AddOperator())
+	defer kv.Stop()
+
+	// The flush happens before the value expires, the reads don't depend on it.
+	assert.NoError(t, kv.SetWithTTL("c", "5", time.Second))
+	assert.NoError(t, kv.Merge("c", "1"))
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, kv.Set(fmt.Sprintf("Filler_%04d", i), strings.Repeat("v", 100)))
+	}
+	kv.flushes.Wait()
+	_, found := kv.memDB.lastWrite("c")
+	assert.False(t, found)
+	v, err := kv.Get("c")
+	assert.NoError(t, err)
+	assert.Equal(t, "6", v)
+
+	time.Sleep(time.Second)
+	v, err = kv.Get("c")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", v)
+}
@@ -0,0 +1,58 @@
+package main
+
+// The settings below can be chosen when the store is opened, the other system settings are the consts defined in KV_Store.go.
+
+import "time"
+
+// Durability : When the records written to the WAL are forced to the disk (fsync).
+// A write is acknowledged once Set or Del returns.
+type Durability int
+
+const (
+	// SyncPerWrite : Every write is synced before being acknowledged, with its own fsync.
+	// An acknowledged write is never lost, even on power failure.
+	SyncPerWrite Durability = iota
+	// SyncGroup : Every write is synced before being acknowledged, but the writers that wait for a sync at the same time share a
+	// single fsync. An acknowledged write is never lost, even on power failure.
+	SyncGroup
+	// SyncInterval : The WAL is synced every SyncInterval, in the background. A write is acknowledged before being synced, on
+	// power failure the writes acknowledged during the last SyncInterval can be lost (a crash of the process alone loses nothing).
+	SyncInterval
+)
+
+// Options : The settings of a kv store instance.
+type Options struct {
+	// Number of bits used for each key by the bloom filter of the SST files, 0 disables the filters.
+	// 10 bits per key give about 1% of false positives.
+	BloomBitsPerKey int
+	// When the WAL is synced to the disk.
+	Durability Durability
+	// Time between two syncs of the WAL, only used with SyncInterval.
+	SyncInterval time.Duration
+	// Picks the SST files merged by the compactions : NewLeveledCompaction() (for read-heavy stores) or NewSizeTieredCompaction()
+	// (for write-heavy stores), see Compaction.go.
+	Compaction CompactionStrategy
+	// Number of compactions run at the same time in the background, 0 disables the background compactions (see
+	// CompactionScheduler.go).
+	MaxBackgroundCompactions int
+	// Approximate number of bytes of the main memory (keys, values and the skiplist nodes) that starts a flush to an SST file.
+	// The main memory is also flushed once it holds "treshold" records (see KV_Store.go), 0 only flushes on the number of records.
+	MemtableSize int64
+	// Folds the operands written by MyKvStore.Merge into the values : Int64AddOperator(), StringAppendOperator(sep) or one of the
+	// application (see Merge.go). nil disables Merge. Once given, an operator of the same name must be given on every open of the
+	// store (its name is recorded in the MANIFEST).
+	MergeOperator MergeOperator
+}
+
+// DefaultOptions returns the options used by NewKeyValueStore.
+func DefaultOptions() Options {
+	return Options{
+		BloomBitsPerKey: 10,
+		Durability:      SyncGroup,
+		SyncInterval:    100 * time.Millisecond,
+		Compaction:      NewLeveledCompaction(),
+
+		MaxBackgroundCompactions: 1,
+		MemtableSize:             4 << 20,
+	}
+}
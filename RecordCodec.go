@@ -0,0 +1,200 @@
+package main
+
+// This file holds the encoding of a single record inside an SST file.
+// Two encodings exist, selected by the system version written in the SST header:
+
+// 1. sysVersJSON (110011) : The legacy encoding, a JSON FileRecord prefixed by its length (int64, big endian).
+// 2. sysVersBinary (110012) : The compact binary encoding described below.
+
+// Binary layout of a record:
+// 1. Operation (1 byte : opSet, opDel or opMerge)
+// 2. Sequence number (8 bytes, little endian), only since sysVersSeq (110016)
+// 3. Expiry (8 bytes, little endian, Unix nanoseconds, 0 if the value never expires), only since sysVersTTL (110017)
+// 4. Key length (4 bytes, little endian)
+// 5. Key (variable length)
+// 6. Value length (4 bytes, little endian)
+// 7. Value (variable length)
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	opSet byte = 1
+	opDel byte = 2
+	// 3 is walBatch, the first byte of a batch in the WAL.
+	opMerge byte = 4
+)
+
+// recordFixedSize : Number of bytes of a record besides its key and its value in the sysVers encoding : the operation, the sequence
+// number, the expiry and the two lengths.
+const recordFixedSize = 1 + 8 + 8 + 4 + 4
+
+// opToByte converts an Operation to its one byte representation.
+func opToByte(op Operation) (byte, error) {
+	switch op {
+	case Put:
+		return opSet, nil
+	case Del:
+		return opDel, nil
+	case Merge:
+		return opMerge, nil
+	}
+	return 0, fmt.Errorf("unknown operation %q", op)
+}
+
+// byteToOp converts the one byte representation back to an Operation.
+func byteToOp(b byte) (Operation, error) {
+	switch b {
+	case opSet:
+		return Put, nil
+	case opDel:
+		return Del, nil
+	case opMerge:
+		return Merge, nil
+	}
+	return "", fmt.Errorf("unknown operation byte %d", b)
+}
+
+// appendRecord appends the binary encoding of the given system version of the record to buf.
+func appendRecord(buf []byte, version uint64, record FileRecord) ([]byte, error) {
+	op, err := opToByte(record.Operation)
+	if err != nil {
+		return buf, err
+	}
+	buf = append(buf, op)
+	if version >= sysVersSeq {
+		buf = binary.LittleEndian.AppendUint64(buf, record.Seq)
+	}
+	if version >= sysVersTTL {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(record.Expiry))
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(record.Key)))
+	buf = append(buf, record.Key...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(record.Value)))
+	buf = append(buf, record.Value...)
+	return buf, nil
+}
+
+// writeRecord writes the record to w using the encoding of the given system version.
+func writeRecord(w io.Writer, version uint64, record FileRecord) error {
+	if version == sysVersJSON {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, int64(len(data))); err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	data, err := appendRecord(nil, version, record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// readRecord reads one record from r using the encoding of the given system version.
+func readRecord(r io.Reader, version uint64) (FileRecord, error) {
+	if version == sysVersJSON {
+		var length int64
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return FileRecord{}, err
+		}
+		if length < 0 {
+			return FileRecord{}, errors.New("negative record length")
+		}
+		data, err := readBytes(r, length)
+		if err != nil {
+			return FileRecord{}, err
+		}
+		var record FileRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return FileRecord{}, err
+		}
+		return record, nil
+	}
+
+	var opb [1]byte
+	if _, err := io.ReadFull(r, opb[:]); err != nil {
+		return FileRecord{}, err
+	}
+	op, err := byteToOp(opb[0])
+	if err != nil {
+		return FileRecord{}, err
+	}
+	var seq uint64
+	if version >= sysVersSeq {
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return FileRecord{}, unexpectedEOF(err)
+		}
+		seq = binary.LittleEndian.Uint64(b[:])
+	}
+	var expiry int64
+	if version >= sysVersTTL {
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return FileRecord{}, unexpectedEOF(err)
+		}
+		expiry = int64(binary.LittleEndian.Uint64(b[:]))
+	}
+	var klen [4]byte
+	if _, err := io.ReadFull(r, klen[:]); err != nil {
+		return FileRecord{}, unexpectedEOF(err)
+	}
+	key, err := readLenPrefixed(r, binary.LittleEndian.Uint32(klen[:]))
+	if err != nil {
+		return FileRecord{}, err
+	}
+	var vlen [4]byte
+	if _, err := io.ReadFull(r, vlen[:]); err != nil {
+		return FileRecord{}, unexpectedEOF(err)
+	}
+	value, err := readLenPrefixed(r, binary.LittleEndian.Uint32(vlen[:]))
+	if err != nil {
+		return FileRecord{}, err
+	}
+	return FileRecord{Operation: op, Key: key, Value: value, Seq: seq, Expiry: expiry}, nil
+}
+
+func readLenPrefixed(r io.Reader, n uint32) (string, error) {
+	data, err := readBytes(r, int64(n))
+	return string(data), err
+}
+
+// readBytes reads n bytes from r. A damaged length can be far beyond the end of the file : past 64 KiB the bytes are read as they
+// come instead of being allocated at once.
+func readBytes(r io.Reader, n int64) ([]byte, error) {
+	if n <= 64<<10 {
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return data, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r, n))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
+
+// A record that stops in the middle is never a clean end of file.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordCodec(t *testing.T) {
+	records := []FileRecord{
+		{Operation: Put, Key: "testKey", Value: "testValue"},
+		{Operation: Del, Key: "deletedKey", Value: ""},
+		{Operation: Put, Key: "", Value: "emptyKey"},
+		{Operation: Put, Key: "expiringKey", Value: "expiringValue", Seq: 7, Expiry: 1700000000000000000},
+	}
+
+	for _, version := range []uint64{sysVersJSON, sysVers} {
+		var buf bytes.Buffer
+		for _, r := range records {
+			assert.NoError(t, writeRecord(&buf, version, r))
+		}
+
+		for _, r := range records {
+			read, err := readRecord(&buf, version)
+			assert.NoError(t, err)
+			assert.Equal(t, r, read)
+		}
+
+		// Nothing left to read.
+		_, err := readRecord(&buf, version)
+		assert.Equal(t, io.EOF, err)
+	}
+
+	// The binary encoding is smaller than the JSON one.
+	var js, bin bytes.Buffer
+	assert.NoError(t, writeRecord(&js, sysVersJSON, records[0]))
+	assert.NoError(t, writeRecord(&bin, sysVers, records[0]))
+	assert.Less(t, bin.Len(), js.Len())
+	assert.Equal(t, recordFixedSize+len(records[0].Key)+len(records[0].Value), bin.Len())
+
+	// The records written before the expiries never expire.
+	var seq bytes.Buffer
+	assert.NoError(t, writeRecord(&seq, sysVersSeq, records[3]))
+	read, err := readRecord(&seq, sysVersSeq)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), read.Expiry)
+	assert.Equal(t, uint64(7), read.Seq)
+
+	// A record cut in the middle is an error, not a clean end of file.
+	bin.Truncate(bin.Len() - 2)
+	_, err = readRecord(&bin, sysVers)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestLoadLegacySST(t *testing.T) {
+	// Write an SST file with the legacy JSON encoding.
+	tmpFile, err := os.CreateTemp("", "sst_test")
+	assert.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	records := []FileRecord{
+		{Operation: Put, Key: "a", Value: "1"},
+		{Operation: Del, Key: "b", Value: ""},
+	}
+	assert.NoError(t, binary.Write(tmpFile, binary.LittleEndian, magicNumber))
+	assert.NoError(t, binary.Write(tmpFile, binary.LittleEndian, sysVersJSON))
+	assert.NoError(t, binary.Write(tmpFile, binary.LittleEndian, uint64(len(records))))
+	for _, r := range records {
+		assert.NoError(t, writeRecord(tmpFile, sysVersJSON, r))
+	}
+
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+
+	ss := newSSTMap()
+	assert.NoError(t, ss.LoadToMem(tmpFile))
+	assert.Equal(t, records, ss.records)
+	got, ok := ss.get("b", latestSeq)
+	assert.True(t, ok)
+	assert.Equal(t, records[1], got)
+
+	// The files without blocks are read at once by the cursor.
+	table, err := openSSTTable(tmpFile)
+	assert.NoError(t, err)
+	c := table.newCursor()
+	assert.NoError(t, c.seek("aa"))
+	assert.Equal(t, records[1], c.record())
+	assert.NoError(t, c.next())
+	assert.False(t, c.valid())
+	assert.NoError(t, c.seekForPrev("aa"))
+	assert.Equal(t, records[0], c.record())
+	assert.NoError(t, c.prev())
+	assert.False(t, c.valid())
+}
+
+func TestLoadLegacySSTBadLength(t *testing.T) {
+	for _, length := range []int64{-5, 1 << 60} {
+		tmpFile, err := os.CreateTemp("", "sst_test")
+		assert.NoError(t, err)
+		defer os.Remove(tmpFile.Name())
+		defer tmpFile.Close()
+
+		// A legacy SST file whose second record has a damaged length.
+		assert.NoError(t, binary.Write(tmpFile, binary.LittleEndian, magicNumber))
+		assert.NoError(t, binary.Write(tmpFile, binary.LittleEndian, sysVersJSON))
+		assert.NoError(t, binary.Write(tmpFile, binary.LittleEndian, uint64(2)))
+		assert.NoError(t, writeRecord(tmpFile, sysVersJSON, FileRecord{Operation: Put, Key: "a", Value: "1"}))
+		assert.NoError(t, binary.Write(tmpFile, binary.BigEndian, length))
+		_, err = tmpFile.Write([]byte(`{"Operation":"set"}`))
+		assert.NoError(t, err)
+
+		ss := newSSTMap()
+		var corrupt *ErrCorruption
+		assert.ErrorAs(t, ss.LoadToMem(tmpFile), &corrupt)
+	}
+}
@@ -1,24 +1,22 @@
 package main
 
-// We will write the structure of the SST file as follows:
+// The SST files written before the block format (see SSTable.go) have the following structure:
 
 // 1. Magic number (8 bytes)
-// 2. Number of records (8 bytes)
-// 3. Key length (8 bytes)
-// 4. Key (variable length)
-// 5. Value length (8 bytes)
-// 6. Value (variable length)
+// 2. System version (8 bytes)
+// 3. Number of records (8 bytes)
+// 4. Records, sorted by key (encoded as described in RecordCodec.go)
 
 import (
-	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 type SSTManager interface {
@@ -30,68 +28,71 @@ type SSTManager interface {
 // It will also keep track of the SST files in memory.
 
 type SSTMap struct {
-	mp map[string]Tuple
+	// The records of the file, sorted by key, the records of a key from the newest to the oldest (see Snapshot.go).
+	records []FileRecord
+	// Index of the newest record of each key.
+	mp map[string]int
 }
 
 func newSSTMap() *SSTMap {
-	v := make(map[string]Tuple)
+	v := make(map[string]int)
 	return &SSTMap{mp: v}
 }
 
-func (stm *SSTMap) LoadToMem(fl *os.File) error {
+// get returns the newest record of the key whose sequence number is not after seq.
+func (stm *SSTMap) get(key string, seq uint64) (FileRecord, bool) {
+	var record FileRecord
+	found := false
+	stm.read(key, seq, func(r FileRecord) bool {
+		record, found = r, true
+		return false
+	})
+	return record, found
+}
 
-	// Read magic number
-	var magic uint64
-	if err := binary.Read(fl, binary.LittleEndian, &magic); err != nil {
-		return err
+// read calls add for the records of the key whose sequence number is not after seq, from the newest to the oldest, until add
+// returns false. It returns false if add did.
+func (stm *SSTMap) read(key string, seq uint64, add func(FileRecord) bool) bool {
+	i, ok := stm.mp[key]
+	if !ok {
+		return true
 	}
-
-	if magic != magicNumber {
-		panic("Invalid SST file")
+	for ; i < len(stm.records) && stm.records[i].Key == key; i++ {
+		if stm.records[i].Seq <= seq && !add(stm.records[i]) {
+			return false
+		}
 	}
+	return true
+}
 
-	// Read system version
-	var sysVersion uint64
-	if err := binary.Read(fl, binary.LittleEndian, &sysVersion); err != nil {
-		return err
-	}
+func (stm *SSTMap) LoadToMem(fl *os.File) error {
 
-	if sysVersion != sysVers {
-		panic("Non Compatible SST file (Check the system version)")
+	table, err := openSSTTable(fl)
+	if err != nil {
+		return err
 	}
-
-	// Read number of records
-	var numRecords uint64
-	if err := binary.Read(fl, binary.LittleEndian, &numRecords); err != nil {
+	// The whole file is read, check it first.
+	if err := table.verify(); err != nil {
 		return err
 	}
 
 	// Read records
-	for i := uint64(0); i < numRecords; i++ {
-
-		var length int64
-		if err := binary.Read(fl, binary.BigEndian, &length); err != nil {
-			return err
+	it := table.newIterator()
+	for {
+		record, err := it.next()
+		if err == io.EOF {
+			return nil
 		}
-
-		// Read the record data
-		data := make([]byte, length)
-		_, err := io.ReadFull(fl, data)
 		if err != nil {
 			return err
 		}
 
-		// Unmarshal the JSON data into a WALRecord
-		var record FileRecord
-		err = json.Unmarshal(data, &record)
-		if err != nil {
-			return err
+		// Records of the same key are stored newest first (see Compaction.go).
+		if _, ok := stm.mp[record.Key]; !ok {
+			stm.mp[record.Key] = len(stm.records)
 		}
-
-		// Put the record in the treemap
-		stm.mp[record.Key] = Tuple{operation: string(record.Operation), value: record.Value}
+		stm.records = append(stm.records, record)
 	}
-	return nil
 }
 
 type mySSTManager struct {
@@ -99,530 +100,384 @@ type mySSTManager struct {
 	sstCount uint64
 	// #of SST files to be loaded to memory.
 	loadCount uint64
-	// Index of the first loaded SST file.
+	// Index of the first SST file loaded to memory on startup.
 	loadIdx       uint64
-	memSST        []SSTMap
 	loadThreshold uint64
+	// Bits per key of the bloom filters written in the new SST files.
+	bitsPerKey int
+
+	// Protects the list of the live SST files and the compactions in progress. The searches hold it while they read the files, so
+	// that no file is deleted under them.
+	mu sync.RWMutex
+	// The live SST files (see Manifest.go), from the oldest to the newest.
+	manifest *manifest
+	files    []*sstFile
+	// SST files of the directory missing from the MANIFEST.
+	orphans []uint64
+	// Picks the SST files merged by the compactions (see Compaction.go).
+	strategy CompactionStrategy
+	// The files merged by the compactions in progress.
+	compacting map[uint64]bool
+	// The live snapshots, the flushes and the compactions keep the records they read (see Snapshot.go).
+	snapshots *snapshotList
+	// Folds the merge operands, nil if the store has none (see Merge.go).
+	mergeOp MergeOperator
+
+	// Number of compactions run at the same time in the background, and the scheduler (see CompactionScheduler.go).
+	maxCompactions int
+	wake           chan struct{}
+	stop           chan struct{}
+	done           chan struct{}
 }
 
-// From the directory, we will load all the SST files into memory.
-// We will also load the info file into memory.
-// The info file will contain the number of SST files and their names.
-// The info file will be used to keep track of the number of SST files and their names.
-
-// This function will create the SST manager.
-// It will create the info file if it doesn't exist.
-// It will also create the directory where the SST files will be stored.
-
-func CheckAndClean() (uint64, error) {
-
-	var numSSTFiles uint64
-	// Create the directory if it doesn't exist
-	if _, err := os.Stat(directory); os.IsNotExist(err) {
-		numSSTFiles = 0
-		if err := os.Mkdir(directory, 0755); err != nil {
-			return 0, err
-		}
-	} else {
-		files, err := os.ReadDir(directory)
-		if err != nil {
-			return 0, err
-		}
-
-		numSSTFiles = uint64(len(files))
-
-		for _, file := range files {
-			//fmt.Println(filepath.Ext(file.Name()))
-			if filepath.Ext(file.Name()) == ext {
-				//fmt.Println("probleeeme")
-				if err := os.Remove(directory + "/" + file.Name()); err != nil {
-					return 0, err
-				}
-				print("removed")
-				numSSTFiles--
-			}
-		}
-	}
-	//print(uint64(numSSTFiles))
-	return uint64(numSSTFiles), nil
+// sstFile : A live SST file, with its records when it is loaded into memory, or else its bloom filter.
+type sstFile struct {
+	fileMeta
+	// nil when the file is searched on the disk.
+	mem *SSTMap
+	// Bloom filter of a file searched on the disk (nil for the files written without a filter).
+	filter *bloomFilter
+	// One reference for the list of the live files, and one for each iterator reading the file (see Iterator.go). The file is
+	// deleted from the disk once it is merged by a compaction and no iterator reads it anymore.
+	refs atomic.Int32
 }
 
-func NewSSTManager(load uint64, treshold uint64) (*mySSTManager, error) {
-
-	numSSTFiles, err := CheckAndClean()
-	if err != nil {
-		return nil, err
-	}
-
-	// 100 SSTMap.
-	idx := math.Max(0, float64(numSSTFiles)-float64(defLoad))
-	//fmt.Printf("idx: %d\n", int(idx))
-	ss := make([]SSTMap, defLoad)
-
-	// DEfault for loadCount = 100
-	return &mySSTManager{
-		sstCount:      numSSTFiles,
-		loadCount:     uint64(load),
-		loadIdx:       uint64(idx),
-		memSST:        ss,
-		loadThreshold: treshold}, nil
+func newSSTFile(meta fileMeta) *sstFile {
+	f := &sstFile{fileMeta: meta}
+	f.refs.Store(1)
+	return f
 }
 
-// This function will load the SST files into memory. From idxLoad to sstCount.
-func (m *mySSTManager) LoadALL() error {
-
-	// New wait group
-	var wg sync.WaitGroup
-	for i := m.loadIdx; i < m.sstCount; i++ {
-		//fmt.Println(i - m.loadIdx)
-
-		// Increment the wait group counter
-		wg.Add(1)
-		// To be removed.
-		go func(i uint64, wg *sync.WaitGroup) error {
-			defer wg.Done()
-			fileName := fmt.Sprintf("%s/SST%d.sst", directory, i)
-			file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-
-			// Load the SST file into memory.
-			m.memSST[i-m.loadIdx].mp = make(map[string]Tuple)
-			if err := m.memSST[i-m.loadIdx].LoadToMem(file); err != nil {
-				return err
-			}
-
-			// Decrement the wait group counter
-			return nil
-		}(i, &wg)
+// unref drops a reference to the file, the last one deletes the file.
+func (f *sstFile) unref() {
+	if f.refs.Add(-1) > 0 {
+		return
+	}
+	if err := os.Remove(sstFileName(directory, f.Num)); err != nil && !os.IsNotExist(err) {
+		fmt.Println("Error while deleting an SST file:", err)
 	}
-
-	// Wait for all the goroutines to finish
-	wg.Wait()
-
-	fmt.Println("All SST files loaded into memory")
-	fmt.Printf("There are %d SST files in memory\n", len(m.memSST))
-	// Print the size of each SST file in memory.
-	/* for i := 0; i < len(m.memSST); i++ {
-		fmt.Printf("SST%d size: %d\n", i, len(m.memSST[i].mp))
-	} */
-	return nil
 }
 
-func (m *mySSTManager) SearchInSST(key string, idx uint64) (string, error) {
+func sstFileName(dir string, num uint64) string {
+	return fmt.Sprintf("%s/SST%d.sst", dir, num)
+}
 
-	filename := fmt.Sprintf("%s/SST%d.sst", directory, idx)
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
-	defer file.Close()
+// The SST files are numbered in the order they are created, a number is never reused.
+// The MANIFEST keeps track of the SST files that are live, the manager keeps the newest ones in memory.
 
-	if err != nil {
-		return "", err
-	}
+// This function will create the directory where the SST files will be stored if it doesn't exist.
+// It will remove the temporary files (SST files that were being written during a crash) and return the numbers of the SST files
+// found, in order.
 
-	// Read magic number
-	var magic uint64
-	if err := binary.Read(file, binary.LittleEndian, &magic); err != nil {
-		return "", err
-	}
+func CheckAndClean() ([]uint64, error) {
 
-	if magic != magicNumber {
-		panic("Invalid SST file")
-	}
-
-	// Read system version
-	var sysVersion uint64
-	if err := binary.Read(file, binary.LittleEndian, &sysVersion); err != nil {
-		return "", err
-	}
-
-	if sysVersion != sysVers {
-		panic("Non Compatible SST file (Check the system version)")
+	// Create the directory if it doesn't exist
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
 	}
-
-	// Read number of records
-	var numRecords uint64
-	if err := binary.Read(file, binary.LittleEndian, &numRecords); err != nil {
-		return "", err
+	files, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
 	}
 
-	// Read records
-	for i := uint64(0); i < numRecords; i++ {
-
-		var length int64
-		if err := binary.Read(file, binary.BigEndian, &length); err != nil {
-			return "", err
-		}
-
-		// Read the record data
-		data := make([]byte, length)
-		_, err := io.ReadFull(file, data)
-		if err != nil {
-			return "", err
-		}
-
-		// Unmarshal the JSON data into a WALRecord
-		var record FileRecord
-		err = json.Unmarshal(data, &record)
-		if err != nil {
-			return "", err
-		}
-
-		// check if the keys match
-		if record.Key == key {
-			if record.Operation == "del" {
-				return "", errors.New("Key Deleted")
+	var nums []uint64
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ext {
+			if err := os.Remove(directory + "/" + file.Name()); err != nil {
+				return nil, err
 			}
-			return record.Value, nil
-		}
-		// We can stop searching if the key is greater than the current key.
-		if record.Key > key {
-			return "", errors.New("Key Not Found")
+			fmt.Println("removed", file.Name())
+			continue
 		}
 
+		var num uint64
+		if n, _ := fmt.Sscanf(file.Name(), "SST%d.sst", &num); n == 1 && file.Name() == fmt.Sprintf("SST%d.sst", num) {
+			nums = append(nums, num)
+		}
 	}
-	return "", errors.New("Key Not Found")
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
 }
 
-func (m *mySSTManager) SearchInDisk(key string) (string, error) {
+func NewSSTManager(load uint64, treshold uint64) (*mySSTManager, error) {
 
-	if m.loadIdx == 0 {
-		return "", errors.New("Key Not Found")
+	found, err := CheckAndClean()
+	if err != nil {
+		return nil, err
 	}
-	for i := m.loadIdx - 1; ; i-- {
-
-		if i > uint64(10000000) {
-			panic("Strange Error Occured")
-		}
-
-		fmt.Println(i, m.loadIdx)
-		val, err := m.SearchInSST(key, i)
-		if err == nil {
-			return val, nil
-		}
-		// if the key is deleted, we can stop searching.
-		if err.Error() == "Key Deleted" {
-			return "", errors.New("Key Deleted")
-		}
-		if i == 0 {
-			return "", errors.New("Key Not Found")
-		}
+	mf, err := openManifest(directory, found)
+	if err != nil {
+		return nil, err
 	}
-	//return "", errors.New("Key Not Found")
-}
 
-func (m *mySSTManager) Search(key string) (string, error) {
+	// DEfault for loadCount = 100
+	m := &mySSTManager{
+		loadCount:     uint64(load),
+		loadThreshold: treshold,
+		manifest:      mf,
+		orphans:       mf.orphans(found),
+		strategy:      NewLeveledCompaction(),
+		compacting:    make(map[uint64]bool),
+		snapshots:     newSnapshotList()}
+	for _, num := range m.orphans {
+		fmt.Printf("Orphaned SST file (not in the MANIFEST): %s\n", sstFileName(directory, num))
+	}
+	m.refresh()
+	return m, nil
+}
 
-	//fmt.Print("eee")
-	// Search in the SST files in memory.
-	for i := len(m.memSST) - 1; i >= 0; i-- {
-		if val, b := m.memSST[i].mp[key]; b {
-			if val.operation == "del" {
-				return "", errors.New("Key Deleted")
-			}
-			return val.value, nil
-		}
+// refresh takes the file set from the MANIFEST, and chooses the SST files to be loaded into memory by LoadALL.
+func (m *mySSTManager) refresh() {
+	m.files = nil
+	for _, meta := range m.manifest.sortedFiles() {
+		m.files = append(m.files, newSSTFile(meta))
 	}
+	m.sstCount = uint64(len(m.files))
+	m.loadIdx = uint64(math.Max(0, float64(m.sstCount)-float64(m.loadCount)))
+}
 
-	//fmt.Print("eee")
-
-	// Search in the SST files on disk.
-	res, err := m.SearchInDisk(key)
-	//fmt.Print("eee")
-	if err != nil {
-		return "", err
+// metas returns the description of the live SST files, from the oldest to the newest.
+func (m *mySSTManager) metas() []fileMeta {
+	metas := make([]fileMeta, len(m.files))
+	for i, f := range m.files {
+		metas[i] = f.fileMeta
 	}
-	return res, nil
+	return metas
 }
 
-// This function will merge two SST files into one, based on their indices.
-func (m *mySSTManager) MergeSST(i, j uint64) error {
+// openFile prepares a new SST file to be searched : its records are loaded into memory while there are less than loadCount SST
+// files, else only its bloom filter is read.
+func (m *mySSTManager) openFile(meta fileMeta) (*sstFile, error) {
+	m.mu.RLock()
+	load := uint64(len(m.files)) < m.loadCount
+	m.mu.RUnlock()
 
-	// Open the two SST files.
-	file1, err := os.OpenFile(fmt.Sprintf("%s/SST%d.sst", directory, i), os.O_RDWR|os.O_CREATE, 0644)
+	file, err := os.Open(sstFileName(directory, meta.Num))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file1.Close()
+	defer file.Close()
 
-	file2, err := os.OpenFile(fmt.Sprintf("%s/SST%d.sst", directory, j), os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return err
+	f := newSSTFile(meta)
+	if load {
+		f.mem = newSSTMap()
+		return f, f.mem.LoadToMem(file)
 	}
-	defer file2.Close()
-
-	// Create a new SST file with a temporary extension.
-	file3, err := os.OpenFile(fmt.Sprintf("%s/SST%d%s", directory, i/2, ext), os.O_RDWR|os.O_CREATE, 0644)
+	table, err := openSSTTable(file)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file3.Close()
+	f.filter = table.filter
+	return f, nil
+}
 
-	// Read magic number
-	var magic1 uint64
-	if err := binary.Read(file1, binary.LittleEndian, &magic1); err != nil {
+// logAndApply records the edit in the MANIFEST, then replaces the deleted files with the added ones in the list of the live files.
+// The added files prepared by openFile are given in opened, the other ones are searched on the disk (a file that only changes level
+// keeps its records in memory). The deleted files are deleted from the disk once no iterator reads them.
+func (m *mySSTManager) logAndApply(edit versionEdit, opened ...*sstFile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.manifest.logAndApply(edit); err != nil {
 		return err
 	}
 
-	var magic2 uint64
-	if err := binary.Read(file2, binary.LittleEndian, &magic2); err != nil {
-		return err
+	live := make(map[uint64]*sstFile)
+	for _, f := range m.files {
+		live[f.Num] = f
 	}
-
-	if magic1 != magic2 || magic1 != magicNumber {
-		panic("Invalid SST files")
+	removed := make(map[uint64]*sstFile)
+	for _, num := range edit.Deleted {
+		if f, ok := live[num]; ok {
+			removed[num] = f
+		}
+		delete(live, num)
 	}
-
-	// Read system version
-	var sysVersion1 uint64
-	if err := binary.Read(file1, binary.LittleEndian, &sysVersion1); err != nil {
-		return err
+	for _, meta := range edit.Added {
+		f := newSSTFile(meta)
+		for _, o := range opened {
+			if o.Num == meta.Num {
+				f = o
+			}
+		}
+		// A file that changes level is the same file, the iterators reading it keep their reference.
+		if old, ok := removed[meta.Num]; ok {
+			old.fileMeta = meta
+			f = old
+			delete(removed, meta.Num)
+		}
+		live[meta.Num] = f
 	}
-	var sysVersion2 uint64
-	if err := binary.Read(file2, binary.LittleEndian, &sysVersion2); err != nil {
-		return err
+	for _, f := range removed {
+		f.unref()
 	}
 
-	if sysVersion1 != sysVersion2 || sysVersion1 != sysVers {
-		panic("Non Compatible SST files (Check the system version)")
+	m.files = m.files[:0:0]
+	for _, f := range live {
+		m.files = append(m.files, f)
 	}
+	sort.Slice(m.files, func(i, j int) bool { return fileLess(m.files[i].fileMeta, m.files[j].fileMeta) })
+	m.sstCount = uint64(len(m.files))
+	return nil
+}
 
-	// Read number of records
-	var numRecords1 uint64
-	if err := binary.Read(file1, binary.LittleEndian, &numRecords1); err != nil {
-		return err
-	}
-	var numRecords2 uint64
-	if err := binary.Read(file2, binary.LittleEndian, &numRecords2); err != nil {
-		return err
-	}
+// This function will load the SST files into memory. From idxLoad to sstCount.
+// The bloom filters of the older SST files are loaded too.
+func (m *mySSTManager) LoadALL() error {
 
-	var totalRecords uint64 = numRecords1 + numRecords2
+	// New wait group
+	var wg sync.WaitGroup
+	// The error met while loading each SST file (if any).
+	errs := make([]error, m.sstCount)
 
-	// Write magic number:
-	if err := binary.Write(file3, binary.LittleEndian, magicNumber); err != nil {
-		return err
-	}
+	for i := uint64(0); i < m.loadIdx; i++ {
+		wg.Add(1)
+		go func(i uint64) {
+			defer wg.Done()
+			file, err := os.Open(sstFileName(directory, m.files[i].Num))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer file.Close()
 
-	// Write system version:
-	if err := binary.Write(file3, binary.LittleEndian, sysVersion1); err != nil {
-		return err
+			// Without a filter the file is always searched.
+			table, err := openSSTTable(file)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			m.files[i].filter = table.filter
+		}(i)
 	}
+	for i := m.loadIdx; i < m.sstCount; i++ {
+		//fmt.Println(i - m.loadIdx)
+
+		// Increment the wait group counter
+		wg.Add(1)
+		// To be removed.
+		go func(i uint64, wg *sync.WaitGroup) {
+			defer wg.Done()
+			file, err := os.Open(sstFileName(directory, m.files[i].Num))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer file.Close()
 
-	// Write the number of records:
+			// Load the SST file into memory.
+			m.files[i].mem = newSSTMap()
+			errs[i] = m.files[i].mem.LoadToMem(file)
+		}(i, &wg)
+	}
 
-	if err := binary.Write(file3, binary.LittleEndian, totalRecords); err != nil {
+	// Wait for all the goroutines to finish
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
 		return err
 	}
 
-	// Set two pointers to the beginning of the two files.
-	// We will read the records from the two files and write them to the third file in the same order.
+	fmt.Println("All SST files loaded into memory")
+	fmt.Printf("There are %d SST files in memory\n", m.sstCount-m.loadIdx)
+	return nil
+}
 
-	f1 := uint64(0)
-	f2 := uint64(0)
-	// Read records
+func (m *mySSTManager) SearchInSST(key string, seq uint64, f *sstFile) (string, error) {
 
-	// Read the first record from the first file.
-	var length1 int64
-	if err := binary.Read(file1, binary.BigEndian, &length1); err != nil {
-		return err
-	}
-
-	// Read the record data
-	data1 := make([]byte, length1)
-	_, err = io.ReadFull(file1, data1)
-	if err != nil {
-		return err
+	v := newMergeValue()
+	if _, err := m.readFile(key, seq, f, v.add); err != nil {
+		return "", err
 	}
+	return v.result(m.mergeOp, key)
+}
 
-	// Unmarshal the JSON data into a WALRecord
-	var record1 FileRecord
-	err = json.Unmarshal(data1, &record1)
-	if err != nil {
-		return err
-	}
+// searchRecord looks for the newest record of the key whose sequence number is not after seq in the SST file.
+func (m *mySSTManager) searchRecord(key string, seq uint64, f *sstFile) (FileRecord, bool, error) {
+	var record FileRecord
+	found := false
+	_, err := m.readFile(key, seq, f, func(r FileRecord) bool {
+		record, found = r, true
+		return false
+	})
+	return record, found, err
+}
 
-	// Read the first record from the second file.
-	var length2 int64
-	if err := binary.Read(file2, binary.BigEndian, &length2); err != nil {
-		return err
+// readFile calls add for the records of the key whose sequence number is not after seq in the SST file, from the newest to the
+// oldest, until add returns false. It returns false if add did.
+func (m *mySSTManager) readFile(key string, seq uint64, f *sstFile, add func(FileRecord) bool) (bool, error) {
+	if f.mem != nil {
+		return f.mem.read(key, seq, add), nil
 	}
 
-	// Read the record data
-	data2 := make([]byte, length2)
-	_, err = io.ReadFull(file2, data2)
+	file, err := os.Open(sstFileName(directory, f.Num))
 	if err != nil {
-		return err
+		return true, err
 	}
+	defer file.Close()
 
-	// Unmarshal the JSON data into a WALRecord
-	var record2 FileRecord
-	err = json.Unmarshal(data2, &record2)
+	table, err := openSSTTable(file)
 	if err != nil {
-		return err
+		return true, err
 	}
+	return table.read(key, seq, add)
+}
 
-	for f1 < numRecords1 && f2 < numRecords2 {
-
-		if record1.Key < record2.Key {
-			// Write the length of the record
-			if err := binary.Write(file3, binary.BigEndian, int64(length1)); err != nil {
-				return err
-			}
-
-			// Write the record data
-			_, err = file3.Write(data1)
-			if err != nil {
-				return err
-			}
-
-			// Read the next record from the first file.
-			if err := binary.Read(file1, binary.BigEndian, &length1); err != nil {
-				if err.Error() == "EOF" {
-					f1++
-					continue
-				}
-			}
-
-			// Read the record data
-			data1 = make([]byte, length1)
-			_, err = io.ReadFull(file1, data1)
-			if err != nil {
-				return err
-			}
-
-			// Unmarshal the JSON data into a WALRecord
-			err = json.Unmarshal(data1, &record1)
-			if err != nil {
-				return err
-			}
-
-			f1++
-		} else {
-
-			// Write the length of the record
-			if err := binary.Write(file3, binary.BigEndian, int64(length2)); err != nil {
-				return err
-			}
-
-			// Write the record data
-			_, err = file3.Write(data2)
-			if err != nil {
-				return err
-			}
-
-			// Read the next record from the second file.
-			if err := binary.Read(file2, binary.BigEndian, &length2); err != nil {
-				if err.Error() == "EOF" {
-					f2++
-					continue
-				}
-			}
-
-			// Read the record data
-			data2 = make([]byte, length2)
-			_, err = io.ReadFull(file2, data2)
-			if err != nil {
-				return err
-			}
-
-			// Unmarshal the JSON data into a WALRecord
-			err = json.Unmarshal(data2, &record2)
-			if err != nil {
-				return err
-			}
+// writtenAfter reports whether the newest record of the key in the SST files was written after seq. m.mu must be held.
+func (m *mySSTManager) writtenAfter(key string, seq uint64) (bool, error) {
+	for i := len(m.files) - 1; i >= 0; i-- {
+		f := m.files[i]
 
-			f2++
+		// A file whose records are all older than seq holds no record written after it.
+		if f.MaxSeq <= seq {
+			continue
 		}
-	}
-
-	//fmt.Println("mmmmmmmmmmmmmmmmmmmmmmmmmmm")
-
-	// Write the remaining records from the first file.
-	for f1 < numRecords1 {
-		// Write the length of the record
-		if err := binary.Write(file3, binary.BigEndian, int64(length1)); err != nil {
-			return err
+		if f.mem == nil && (key < f.Smallest || key > f.Largest || (f.filter != nil && !f.filter.mayContain(key))) {
+			continue
 		}
-
-		// Write the record data
-		_, err = file3.Write(data1)
-		if err != nil {
-			return err
+		record, found, err := m.searchRecord(key, latestSeq, f)
+		if err != nil || found {
+			return found && record.Seq > seq, err
 		}
+	}
+	return false, nil
+}
 
-		// Read the next record from the first file.
-		if err := binary.Read(file1, binary.BigEndian, &length1); err != nil {
-			if err.Error() == "EOF" {
-				break
-			}
-		}
+// Search looks for the newest record of the key in the SST files.
+func (m *mySSTManager) Search(key string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.searchAt(key, latestSeq)
+}
 
-		// Read the record data
-		data1 = make([]byte, length1)
-		_, err = io.ReadFull(file1, data1)
-		if err != nil {
-			return err
-		}
+// searchAt looks for the newest record of the key whose sequence number is not after seq in the SST files, from the newest to the
+// oldest, in memory for the loaded files and on the disk for the other ones. m.mu must be held.
+func (m *mySSTManager) searchAt(key string, seq uint64) (string, error) {
+	return m.searchFrom(key, seq, newMergeValue())
+}
 
-	}
+// searchFrom adds the records of the key found in the SST files to v, which holds the merge operands read in the memories (see
+// Merge.go), and returns the value of the key. m.mu must be held.
+func (m *mySSTManager) searchFrom(key string, seq uint64, v *mergeValue) (string, error) {
+	for i := len(m.files) - 1; i >= 0; i-- {
+		f := m.files[i]
 
-	// Write the remaining records from the second file.
-	for f2 < numRecords2 {
-		// Write the length of the record
-		if err := binary.Write(file3, binary.BigEndian, int64(length2)); err != nil {
-			return err
+		// Skip the files on the disk that cannot hold the key.
+		if f.mem == nil && (key < f.Smallest || key > f.Largest || (f.filter != nil && !f.filter.mayContain(key))) {
+			continue
 		}
 
-		// Write the record data
-		_, err = file3.Write(data2)
+		// The newest record found is the value of the key, even a deleted or expired one. An older file may hold a stale value, never
+		// fall back to it. Only the merge operands let the search go on.
+		more, err := m.readFile(key, seq, f, v.add)
 		if err != nil {
-			return err
-		}
-
-		// Read the next record from the second file.
-		if err := binary.Read(file2, binary.BigEndian, &length2); err != nil {
-			if err.Error() == "EOF" {
-				break
-			}
+			return "", err
 		}
-
-		// Read the record data
-		data2 = make([]byte, length2)
-		_, err = io.ReadFull(file2, data2)
-		if err != nil {
-			return err
+		if !more {
+			break
 		}
-
-	}
-
-	//fmt.Println("mmmmmmmmmmmmmmmmmmmmmmmmmmm")
-	// Close the tree files.
-	file1.Close()
-	file2.Close()
-	file3.Close()
-
-	// Delete the two files.
-	if err := os.Remove(fmt.Sprintf("%s/SST%d.sst", directory, j)); err != nil {
-		return err
-	}
-	
-	if err := os.Remove(fmt.Sprintf("%s/SST%d.sst", directory, i)); err != nil {
-		return err
-	}
-
-	// Rename the third file.
-	i = i / 2
-	oldName := fmt.Sprintf("%s/SST%d%s", directory, i, ext)
-	newfileName := fmt.Sprintf("%s/SST%d.sst", directory, i)
-	if err := os.Rename(oldName, newfileName); err != nil {
-		return err
 	}
-
-	return nil
+	return v.result(m.mergeOp, key)
 }
 
 // WriteToSST writes the records to the SST file.
-// All the records are stored in a treemap.
-// To retrieve them in sorted order we will use the Iterator() method of the treemap.
+// All the records are stored in a skiplist.
+// To retrieve them in sorted order we will use the Iterator() method of the skiplist.
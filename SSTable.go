@@ -0,0 +1,659 @@
+package main
+
+// Since sysVersBlocks the SST files are split in data blocks, so that a lookup only reads the block that may hold the key.
+// Since sysVersFilter they also hold a bloom filter of their keys (see BloomFilter.go).
+// Since sysVersChecksum every block is followed by its CRC32C checksum, and the footer holds the checksum of the whole file.
+// Since sysVersSeq every record holds the sequence number of its write (see RecordCodec.go). A key may have several records, the
+// newest first, when a snapshot still reads the older ones (see Snapshot.go).
+// Since sysVersTTL every record holds the expiry of its value as well.
+// We will write the structure of the SST file as follows:
+
+// 1. Magic number (8 bytes)
+// 2. System version (8 bytes)
+// 3. Data blocks : records sorted by key (encoded as described in RecordCodec.go), a block is closed once it holds at least
+// blockSize bytes. Each block is followed by its checksum (4 bytes).
+// 4. Index block : one entry per data block, in order, followed by its checksum (4 bytes) :
+//    Last key length (4 bytes) | Last key (variable length) | Block offset (8 bytes) | Block length (8 bytes)
+// 5. Filter block : The bloom filter of the keys, empty if the filters are disabled. Followed by its checksum (4 bytes).
+// 6. Footer (56 bytes) : Filter offset (8 bytes) | Filter length (8 bytes) | Index offset (8 bytes) | Index length (8 bytes) |
+//    Number of records (8 bytes) | File checksum (8 bytes) | Magic number (8 bytes)
+
+// The lengths stored in the index and in the footer don't count the checksum that follows each block.
+// The file checksum covers all the bytes that come before it.
+
+// The files written with sysVersFilter have no checksums and a 48 bytes footer, without the file checksum.
+// The files written with sysVersBlocks have no filter block either and a 32 bytes footer, without the filter offset and length.
+
+// All the integers are little endian.
+// Files written with an older system version have no blocks, their records directly follow the header (see SSTManager.go).
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+const headerSize = 16
+const blocksFooterSize = 32
+const filterFooterSize = 48
+const footerSize = 56
+const checksumSize = 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// blockHandle locates a data block in the SST file.
+type blockHandle struct {
+	lastKey string
+	offset  uint64
+	length  uint64
+}
+
+// sstWriter writes sorted records to an SST file using the block format.
+type sstWriter struct {
+	out      *bufio.Writer
+	crc      hash.Hash32
+	offset   uint64
+	block    []byte
+	firstKey string
+	lastKey  string
+	index    []blockHandle
+	count    uint64
+	// Hashes of the keys, for the bloom filter.
+	hashes     []uint64
+	bitsPerKey int
+}
+
+// newSSTWriter writes the header of the SST file, records can then be added in sorted order.
+// bitsPerKey is the size of the bloom filter for each key, 0 disables the filter.
+func newSSTWriter(fl *os.File, bitsPerKey int) (*sstWriter, error) {
+	w := &sstWriter{out: bufio.NewWriter(fl), crc: crc32.New(crcTable), bitsPerKey: bitsPerKey}
+
+	// Write magic number and system version:
+	var header []byte
+	header = binary.LittleEndian.AppendUint64(header, magicNumber)
+	header = binary.LittleEndian.AppendUint64(header, sysVers)
+	if err := w.write(header); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// write writes p to the file and adds it to the file checksum.
+func (w *sstWriter) write(p []byte) error {
+	if _, err := w.out.Write(p); err != nil {
+		return err
+	}
+	w.crc.Write(p)
+	w.offset += uint64(len(p))
+	return nil
+}
+
+// writeBlock writes the block followed by its checksum, and returns the offset of the block.
+func (w *sstWriter) writeBlock(block []byte) (uint64, error) {
+	offset := w.offset
+	if err := w.write(block); err != nil {
+		return 0, err
+	}
+	if err := w.write(binary.LittleEndian.AppendUint32(nil, crc32.Checksum(block, crcTable))); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// add appends a record to the current data block, the records must be added sorted by key.
+func (w *sstWriter) add(record FileRecord) error {
+	if w.count > 0 && record.Key < w.lastKey {
+		return errNotSorted
+	}
+	var err error
+	w.block, err = appendRecord(w.block, sysVers, record)
+	if err != nil {
+		return err
+	}
+	if w.count == 0 {
+		w.firstKey = record.Key
+	}
+	w.lastKey = record.Key
+	w.count++
+	if w.bitsPerKey > 0 {
+		w.hashes = append(w.hashes, bloomHash(record.Key))
+	}
+
+	if len(w.block) >= blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *sstWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	offset, err := w.writeBlock(w.block)
+	if err != nil {
+		return err
+	}
+	w.index = append(w.index, blockHandle{lastKey: w.lastKey, offset: offset, length: uint64(len(w.block))})
+	w.block = w.block[:0]
+	return nil
+}
+
+// finish writes the last data block, the index block, the filter block and the footer.
+func (w *sstWriter) finish() error {
+	if err := w.flushBlock(); err != nil {
+		return err
+	}
+
+	// Write the index block.
+	var index []byte
+	for _, h := range w.index {
+		index = binary.LittleEndian.AppendUint32(index, uint32(len(h.lastKey)))
+		index = append(index, h.lastKey...)
+		index = binary.LittleEndian.AppendUint64(index, h.offset)
+		index = binary.LittleEndian.AppendUint64(index, h.length)
+	}
+	indexOffset, err := w.writeBlock(index)
+	if err != nil {
+		return err
+	}
+
+	// Write the filter block.
+	var filter []byte
+	if w.bitsPerKey > 0 {
+		filter = newBloomFilter(w.hashes, w.bitsPerKey).encode()
+	}
+	filterOffset, err := w.writeBlock(filter)
+	if err != nil {
+		return err
+	}
+
+	// Write the footer, the file checksum covers everything before it.
+	var footer []byte
+	footer = binary.LittleEndian.AppendUint64(footer, filterOffset)
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(filter)))
+	footer = binary.LittleEndian.AppendUint64(footer, indexOffset)
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(index)))
+	footer = binary.LittleEndian.AppendUint64(footer, w.count)
+	if err := w.write(footer); err != nil {
+		return err
+	}
+	footer = binary.LittleEndian.AppendUint64(nil, uint64(w.crc.Sum32()))
+	footer = binary.LittleEndian.AppendUint64(footer, magicNumber)
+	if err := w.write(footer); err != nil {
+		return err
+	}
+
+	return w.out.Flush()
+}
+
+// fileMeta returns the description of the file written, to be recorded in the MANIFEST (see Manifest.go).
+func (w *sstWriter) fileMeta(num uint64, maxSeq uint64) fileMeta {
+	return fileMeta{Num: num, Smallest: w.firstKey, Largest: w.lastKey, Size: int64(w.offset), MaxSeq: maxSeq}
+}
+
+// sstTable gives access to the records of an SST file, whatever the system version it was written with.
+type sstTable struct {
+	fl      *os.File
+	version uint64
+	count   uint64
+	// Only for the block format.
+	index []blockHandle
+	size  int64
+	// nil if the file has no filter.
+	filter *bloomFilter
+	// Only for the checksummed format.
+	checksum uint32
+}
+
+// corruption returns an ErrCorruption for this file.
+func (t *sstTable) corruption(offset int64, reason string) error {
+	return &ErrCorruption{File: t.fl.Name(), Offset: offset, Reason: reason}
+}
+
+// openSSTTable reads and checks the header of the SST file, and its footer and index block if it uses the block format.
+func openSSTTable(fl *os.File) (*sstTable, error) {
+	t := &sstTable{fl: fl}
+
+	var header [headerSize + 8]byte
+	n, err := fl.ReadAt(header[:], 0)
+	if n < headerSize {
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, t.corruption(0, "file too short for the header")
+	}
+
+	if binary.LittleEndian.Uint64(header[0:]) != magicNumber {
+		return nil, t.corruption(0, "invalid magic number")
+	}
+
+	t.version = binary.LittleEndian.Uint64(header[8:])
+
+	switch t.version {
+	case sysVersJSON, sysVersBinary:
+		// The number of records follows the header.
+		if n < len(header) {
+			return nil, t.corruption(headerSize, "missing number of records")
+		}
+		t.count = binary.LittleEndian.Uint64(header[16:])
+		return t, nil
+	case sysVersBlocks, sysVersFilter, sysVersChecksum, sysVersSeq, sysVersTTL:
+		if err := t.readIndex(); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	return nil, t.corruption(8, fmt.Sprintf("non compatible SST file, system version %d", t.version))
+}
+
+// blocks reports whether the file uses the block format.
+func (t *sstTable) blocks() bool {
+	return t.version >= sysVersBlocks
+}
+
+// checksums reports whether the blocks of the file are followed by a checksum.
+func (t *sstTable) checksums() bool {
+	return t.version >= sysVersChecksum
+}
+
+func (t *sstTable) readIndex() error {
+	info, err := t.fl.Stat()
+	if err != nil {
+		return err
+	}
+	t.size = info.Size()
+
+	size := int64(blocksFooterSize)
+	if t.version >= sysVersChecksum {
+		size = footerSize
+	} else if t.version >= sysVersFilter {
+		size = filterFooterSize
+	}
+	if t.size < headerSize+size {
+		return t.corruption(0, "file too short for the footer")
+	}
+
+	footer := make([]byte, size)
+	if _, err := t.fl.ReadAt(footer, t.size-size); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(footer[size-8:]) != magicNumber {
+		return t.corruption(t.size-8, "invalid magic number in the footer")
+	}
+	if t.checksums() {
+		t.checksum = uint32(binary.LittleEndian.Uint64(footer[size-16:]))
+	}
+
+	// The end of the footer is the same for all the block formats.
+	if t.version >= sysVersFilter {
+		filterOffset := binary.LittleEndian.Uint64(footer[0:])
+		filterLength := binary.LittleEndian.Uint64(footer[8:])
+		filter, err := t.readBlockData(filterOffset, filterLength)
+		if err != nil {
+			return err
+		}
+		t.filter = decodeBloomFilter(filter)
+		footer = footer[16:]
+	}
+	indexOffset := binary.LittleEndian.Uint64(footer[0:])
+	indexLength := binary.LittleEndian.Uint64(footer[8:])
+	t.count = binary.LittleEndian.Uint64(footer[16:])
+
+	index, err := t.readBlockData(indexOffset, indexLength)
+	if err != nil {
+		return err
+	}
+	for len(index) > 0 {
+		if len(index) < 4 {
+			return t.corruption(int64(indexOffset), "truncated index block")
+		}
+		klen := binary.LittleEndian.Uint32(index)
+		index = index[4:]
+		if uint64(len(index)) < uint64(klen)+16 {
+			return t.corruption(int64(indexOffset), "truncated index block")
+		}
+		t.index = append(t.index, blockHandle{
+			lastKey: string(index[:klen]),
+			offset:  binary.LittleEndian.Uint64(index[klen:]),
+			length:  binary.LittleEndian.Uint64(index[klen+8:]),
+		})
+		index = index[klen+16:]
+	}
+	return nil
+}
+
+// readBlockData reads a block and checks its checksum if the file has checksums.
+func (t *sstTable) readBlockData(offset, length uint64) ([]byte, error) {
+	n := length
+	if t.checksums() {
+		n += checksumSize
+	}
+	if offset > uint64(t.size) || n > uint64(t.size)-offset {
+		return nil, t.corruption(int64(offset), "block goes past the end of the file")
+	}
+
+	data := make([]byte, n)
+	if _, err := t.fl.ReadAt(data, int64(offset)); err != nil {
+		return nil, err
+	}
+	if t.checksums() {
+		if crc32.Checksum(data[:length], crcTable) != binary.LittleEndian.Uint32(data[length:]) {
+			return nil, t.corruption(int64(offset), "block checksum mismatch")
+		}
+		data = data[:length]
+	}
+	return data, nil
+}
+
+// readBlock reads and decodes all the records of a data block.
+func (t *sstTable) readBlock(h blockHandle) ([]FileRecord, error) {
+	data, err := t.readBlockData(h.offset, h.length)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []FileRecord
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		pos := int64(h.offset) + int64(len(data)-r.Len())
+		record, err := readRecord(r, t.version)
+		if err != nil {
+			return nil, t.corruption(pos, "bad record: "+unexpectedEOF(err).Error())
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// verify checks the checksum of the whole file, the files written without checksums are always valid.
+func (t *sstTable) verify() error {
+	if !t.checksums() {
+		return nil
+	}
+	crc := crc32.New(crcTable)
+	end := t.size - 16
+	if _, err := io.Copy(crc, io.NewSectionReader(t.fl, 0, end)); err != nil {
+		return err
+	}
+	if crc.Sum32() != t.checksum {
+		return t.corruption(end, "file checksum mismatch")
+	}
+	return nil
+}
+
+// get looks for the newest record of the key whose sequence number is not after seq.
+func (t *sstTable) get(key string, seq uint64) (FileRecord, bool, error) {
+	var record FileRecord
+	found := false
+	_, err := t.read(key, seq, func(r FileRecord) bool {
+		record, found = r, true
+		return false
+	})
+	return record, found, err
+}
+
+// read calls add for the records of the key whose sequence number is not after seq, from the newest to the oldest, until add
+// returns false. It returns false if add did.
+// For the block format this is a binary search in the index followed by the read of a single block (the records of a key are
+// rarely split over the next blocks).
+func (t *sstTable) read(key string, seq uint64, add func(FileRecord) bool) (bool, error) {
+	if !t.blocks() {
+		return t.scan(key, seq, add)
+	}
+	if t.filter != nil && !t.filter.mayContain(key) {
+		return true, nil
+	}
+
+	// The first block whose last key is not smaller than the key is the first one that may hold it.
+	for i := sort.Search(len(t.index), func(i int) bool { return t.index[i].lastKey >= key }); i < len(t.index); i++ {
+		records, err := t.readBlock(t.index[i])
+		if err != nil {
+			return true, err
+		}
+		for _, record := range records {
+			if record.Key > key {
+				return true, nil
+			}
+			if record.Key == key && record.Seq <= seq && !add(record) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// scan reads the records one by one, this is the only way to search the files written before the block format.
+func (t *sstTable) scan(key string, seq uint64, add func(FileRecord) bool) (bool, error) {
+	it := t.newIterator()
+	for {
+		record, err := it.next()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return true, err
+		}
+		// We can stop searching if the key is greater than the current key.
+		if record.Key > key {
+			return true, nil
+		}
+		if record.Key == key && record.Seq <= seq && !add(record) {
+			return false, nil
+		}
+	}
+}
+
+// sstIterator reads all the records of an SST file in order.
+type sstIterator struct {
+	t *sstTable
+	// Stream formats.
+	r    *bufio.Reader
+	pos  int64
+	left uint64
+	// Block format.
+	block   []FileRecord
+	nextBlk int
+}
+
+func (t *sstTable) newIterator() *sstIterator {
+	it := &sstIterator{t: t}
+	if !t.blocks() {
+		it.pos = headerSize + 8
+		it.r = bufio.NewReader(io.NewSectionReader(t.fl, it.pos, 1<<62))
+		it.left = t.count
+	}
+	return it
+}
+
+// next returns the next record of the file, or io.EOF once all the records have been read.
+func (it *sstIterator) next() (FileRecord, error) {
+	if !it.t.blocks() {
+		if it.left == 0 {
+			return FileRecord{}, io.EOF
+		}
+		cr := &countingReader{r: it.r}
+		record, err := readRecord(cr, it.t.version)
+		if err != nil {
+			return FileRecord{}, it.t.corruption(it.pos, "bad record: "+unexpectedEOF(err).Error())
+		}
+		it.pos += cr.n
+		it.left--
+		return record, nil
+	}
+
+	for len(it.block) == 0 {
+		if it.nextBlk == len(it.t.index) {
+			return FileRecord{}, io.EOF
+		}
+		var err error
+		it.block, err = it.t.readBlock(it.t.index[it.nextBlk])
+		if err != nil {
+			return FileRecord{}, err
+		}
+		it.nextBlk++
+	}
+	record := it.block[0]
+	it.block = it.block[1:]
+	return record, nil
+}
+
+// sstCursor moves through the records of an SST file in both directions, reading a block at a time. The files written before the
+// block format are read at once, as a single block.
+type sstCursor struct {
+	t *sstTable
+	// The block loaded, and the position in its records. records is nil once the cursor moved past the first or the last record.
+	blk     int
+	records []FileRecord
+	i       int
+}
+
+func (t *sstTable) newCursor() *sstCursor {
+	return &sstCursor{t: t}
+}
+
+func (c *sstCursor) numBlocks() int {
+	if !c.t.blocks() {
+		return 1
+	}
+	return len(c.t.index)
+}
+
+func (c *sstCursor) load(blk int) error {
+	c.blk = blk
+	if c.t.blocks() {
+		records, err := c.t.readBlock(c.t.index[blk])
+		c.records = records
+		return err
+	}
+	c.records = []FileRecord{}
+	it := c.t.newIterator()
+	for {
+		record, err := it.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.records = append(c.records, record)
+	}
+}
+
+// valid reports whether the cursor is on a record.
+func (c *sstCursor) valid() bool {
+	return c.records != nil && c.i >= 0 && c.i < len(c.records)
+}
+
+func (c *sstCursor) record() FileRecord {
+	return c.records[c.i]
+}
+
+// seek moves to the first record whose key is not smaller than key.
+func (c *sstCursor) seek(key string) error {
+	blk := 0
+	if c.t.blocks() {
+		// The first block whose last key is not smaller than the key.
+		blk = sort.Search(len(c.t.index), func(i int) bool { return c.t.index[i].lastKey >= key })
+	}
+	if blk == c.numBlocks() {
+		c.records = nil
+		return nil
+	}
+	if err := c.load(blk); err != nil {
+		return err
+	}
+	c.i = sort.Search(len(c.records), func(i int) bool { return c.records[i].Key >= key })
+	return c.forward()
+}
+
+// seekForPrev moves to the last record whose key is not greater than key.
+func (c *sstCursor) seekForPrev(key string) error {
+	blk := 0
+	if c.t.blocks() {
+		// The first block whose last key is not smaller than the key, or else the last block.
+		blk = min(sort.Search(len(c.t.index), func(i int) bool { return c.t.index[i].lastKey >= key }), len(c.t.index)-1)
+	}
+	if blk < 0 {
+		c.records = nil
+		return nil
+	}
+	if err := c.load(blk); err != nil {
+		return err
+	}
+	c.i = sort.Search(len(c.records), func(i int) bool { return c.records[i].Key > key }) - 1
+	return c.backward()
+}
+
+// seekToLast moves to the last record of the file.
+func (c *sstCursor) seekToLast() error {
+	if c.numBlocks() == 0 {
+		c.records = nil
+		return nil
+	}
+	if err := c.load(c.numBlocks() - 1); err != nil {
+		return err
+	}
+	c.i = len(c.records) - 1
+	return c.backward()
+}
+
+func (c *sstCursor) next() error {
+	c.i++
+	return c.forward()
+}
+
+func (c *sstCursor) prev() error {
+	c.i--
+	return c.backward()
+}
+
+// forward loads the next blocks while the cursor is past the records of the block.
+func (c *sstCursor) forward() error {
+	for c.records != nil && c.i >= len(c.records) {
+		if c.blk+1 >= c.numBlocks() {
+			c.records = nil
+			return nil
+		}
+		if err := c.load(c.blk + 1); err != nil {
+			return err
+		}
+		c.i = 0
+	}
+	return nil
+}
+
+// backward loads the previous blocks while the cursor is before the records of the block.
+func (c *sstCursor) backward() error {
+	for c.records != nil && c.i < 0 {
+		if c.blk == 0 {
+			c.records = nil
+			return nil
+		}
+		if err := c.load(c.blk - 1); err != nil {
+			return err
+		}
+		c.i = len(c.records) - 1
+	}
+	return nil
+}
+
+// countingReader counts the bytes read, to locate the records of the stream formats.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+var errNotSorted = errors.New("records must be added to an SST file sorted by key")
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestSST writes the records to a temporary SST file and opens it.
+func writeTestSST(t *testing.T, records []FileRecord) *sstTable {
+	tmpFile, err := os.CreateTemp("", "sst_test")
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	})
+
+	w, err := newSSTWriter(tmpFile, DefaultOptions().BloomBitsPerKey)
+	assert.NoError(t, err)
+	for _, r := range records {
+		assert.NoError(t, w.add(r))
+	}
+	assert.NoError(t, w.finish())
+
+	table, err := openSSTTable(tmpFile)
+	assert.NoError(t, err)
+	return table
+}
+
+func TestSSTableBlocks(t *testing.T) {
+	var records []FileRecord
+	for i := 0; i < 2000; i++ {
+		op := Put
+		if i%10 == 0 {
+			op = Del
+		}
+		records = append(records, FileRecord{Operation: op, Key: fmt.Sprintf("Key_%05d", i*2), Value: fmt.Sprintf("Value_%d", i)})
+	}
+	table := writeTestSST(t, records)
+
+	// The records are spread over several blocks.
+	assert.Equal(t, uint64(len(records)), table.count)
+	assert.Greater(t, len(table.index), 1)
+
+	// Every key can be found.
+	for _, r := range records {
+		got, found, err := table.get(r.Key, latestSeq)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, r, got)
+	}
+
+	// Keys between, before and after the stored keys are missing.
+	for _, key := range []string{"Key_00001", "Key_03999", "A", "Z"} {
+		_, found, err := table.get(key, latestSeq)
+		assert.NoError(t, err)
+		assert.False(t, found)
+	}
+
+	// The iterator returns all the records in order.
+	it := table.newIterator()
+	for _, r := range records {
+		got, err := it.next()
+		assert.NoError(t, err)
+		assert.Equal(t, r, got)
+	}
+	_, err := it.next()
+	assert.Equal(t, io.EOF, err)
+
+	// The cursor seeks the first key not smaller than the one given, or the last key not greater, in any block.
+	c := table.newCursor()
+	for _, i := range []int{0, 1, 999, 1000, 3997} {
+		assert.NoError(t, c.seek(fmt.Sprintf("Key_%05d", i)))
+		assert.True(t, c.valid())
+		assert.Equal(t, records[(i+1)/2], c.record())
+		assert.NoError(t, c.seekForPrev(fmt.Sprintf("Key_%05d", i)))
+		assert.True(t, c.valid())
+		assert.Equal(t, records[i/2], c.record())
+	}
+	assert.NoError(t, c.seek("Z"))
+	assert.False(t, c.valid())
+	assert.NoError(t, c.seekForPrev("A"))
+	assert.False(t, c.valid())
+
+	// It goes through all the records both ways.
+	assert.NoError(t, c.seekToLast())
+	for i := len(records) - 1; i >= 0; i-- {
+		assert.True(t, c.valid())
+		assert.Equal(t, records[i], c.record())
+		assert.NoError(t, c.prev())
+	}
+	assert.False(t, c.valid())
+	assert.NoError(t, c.seek(""))
+	for _, r := range records {
+		assert.Equal(t, r, c.record())
+		assert.NoError(t, c.next())
+	}
+	assert.False(t, c.valid())
+}
+
+func TestSSTableEmptyAndUnsorted(t *testing.T) {
+	table := writeTestSST(t, nil)
+	assert.Equal(t, uint64(0), table.count)
+	_, found, err := table.get("a", latestSeq)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	w := &sstWriter{}
+	w.lastKey, w.count = "b", 1
+	assert.Equal(t, errNotSorted, w.add(FileRecord{Operation: Put, Key: "a"}))
+}
+
+func TestSSTableBloomFilter(t *testing.T) {
+	var records []FileRecord
+	for i := 0; i < 1000; i++ {
+		records = append(records, FileRecord{Operation: Put, Key: fmt.Sprintf("Key_%d", i), Value: "v"})
+	}
+	sortRecords(records)
+	table := writeTestSST(t, records)
+	assert.NotNil(t, table.filter)
+
+	// No false negatives.
+	for _, r := range records {
+		assert.True(t, table.filter.mayContain(r.Key))
+	}
+
+	// With 10 bits per key, about 1% of the missing keys pass the filter.
+	passed := 0
+	for i := 0; i < 10000; i++ {
+		if table.filter.mayContain(fmt.Sprintf("Missing_%d", i)) {
+			passed++
+		}
+	}
+	assert.Less(t, passed, 300)
+}
+
+func sortRecords(records []FileRecord) {
+	// Stable : the records of a key are given from the newest to the oldest.
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+}
+
+func TestSSTableCorruption(t *testing.T) {
+	var records []FileRecord
+	for i := 0; i < 1000; i++ {
+		records = append(records, FileRecord{Operation: Put, Key: fmt.Sprintf("Key_%04d", i), Value: "Value"})
+	}
+	table := writeTestSST(t, records)
+	assert.NoError(t, table.verify())
+
+	// Flip a bit in the second data block.
+	offset := int64(table.index[1].offset) + 10
+	b := make([]byte, 1)
+	_, err := table.fl.ReadAt(b, offset)
+	assert.NoError(t, err)
+	b[0] ^= 0x01
+	_, err = table.fl.WriteAt(b, offset)
+	assert.NoError(t, err)
+
+	// The whole file checksum no longer matches.
+	var corrupt *ErrCorruption
+	assert.ErrorAs(t, table.verify(), &corrupt)
+	assert.Equal(t, table.fl.Name(), corrupt.File)
+
+	// Reading the damaged block fails, the other blocks can still be read.
+	_, _, err = table.get(table.index[1].lastKey, latestSeq)
+	assert.ErrorAs(t, err, &corrupt)
+	assert.Equal(t, int64(table.index[1].offset), corrupt.Offset)
+
+	got, found, err := table.get(records[0].Key, latestSeq)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, records[0], got)
+
+	// A bad magic number is an error, not a panic.
+	_, err = table.fl.WriteAt([]byte{0}, 0)
+	assert.NoError(t, err)
+	_, err = openSSTTable(table.fl)
+	assert.ErrorAs(t, err, &corrupt)
+	assert.Equal(t, int64(0), corrupt.Offset)
+}
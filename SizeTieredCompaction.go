@@ -0,0 +1,70 @@
+package main
+
+// The size-tiered compaction merges SST files of similar sizes, as in Cassandra. It writes less than the leveled compaction (a record is
+// merged again only once enough files of its size are written), but a lookup may have to search more files.
+
+// All the files stay in L0 and overlap. A bucket is a run of consecutive files (in the order they were written) whose sizes are all
+// close to the average size of the run, between BucketLow and BucketHigh times it. A bucket of MinThreshold files or more is merged into
+// a single file, the bucket of the smallest files first. Only consecutive files are merged : the merged file takes the place of the
+// run, so the files newer than it never hold older records.
+
+// The deeper levels left by the leveled compaction (when the strategy is changed) are never compacted, they are older than L0.
+
+// SizeTieredCompaction : The size-tiered compaction strategy, described above.
+type SizeTieredCompaction struct {
+	// Minimum and maximum number of files merged at once.
+	MinThreshold int
+	MaxThreshold int
+	// Bounds of the size of a file of a bucket, relative to the average size of the bucket.
+	BucketLow  float64
+	BucketHigh float64
+}
+
+func NewSizeTieredCompaction() *SizeTieredCompaction {
+	return &SizeTieredCompaction{MinThreshold: 4, MaxThreshold: 32, BucketLow: 0.5, BucketHigh: 1.5}
+}
+
+// PickCompaction returns the bucket of the smallest files that holds at least MinThreshold files, or nil if there is none.
+// The files being compacted split the runs.
+func (st *SizeTieredCompaction) PickCompaction(files []fileMeta, compacting map[uint64]bool) *compaction {
+	runs := levelFiles(files, 0)
+	minFiles := max(st.MinThreshold, 2)
+	maxFiles := max(st.MaxThreshold, minFiles)
+
+	var bucket []fileMeta
+	var bucketAvg float64
+	for i := 0; i < len(runs); {
+		if compacting[runs[i].Num] {
+			i++
+			continue
+		}
+
+		// Extend the bucket while the next file has a size close to the average.
+		j, total := i+1, runs[i].Size
+		for j < len(runs) && j-i < maxFiles && !compacting[runs[j].Num] {
+			avg := float64(total) / float64(j-i)
+			size := float64(runs[j].Size)
+			if size < avg*st.BucketLow || size > avg*st.BucketHigh {
+				break
+			}
+			total += runs[j].Size
+			j++
+		}
+
+		avg := float64(total) / float64(j-i)
+		if j-i >= minFiles && (bucket == nil || avg < bucketAvg) {
+			bucket, bucketAvg = runs[i:j], avg
+		}
+		i = j
+	}
+	if bucket == nil {
+		return nil
+	}
+
+	// The inputs are given from the newest to the oldest.
+	c := &compaction{outputLevel: 0}
+	for i := len(bucket) - 1; i >= 0; i-- {
+		c.inputs = append(c.inputs, bucket[i])
+	}
+	return c
+}
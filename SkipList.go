@@ -0,0 +1,336 @@
+package main
+
+// The main memory is a skiplist : the records are kept sorted by key in a linked list, each node is also linked at a random number of
+// levels above the list, so that a lookup skips most of the nodes.
+
+// A single writer (the commit leader, see GroupCommit.go) adds and updates the records, while any number of readers search and iterate
+// the skiplist without any lock. A node is fully written before the writer links it with an atomic store, from the bottom level up, so
+// a reader either sees it complete or doesn't see it. A key set again gets a new record, linked before the older ones with an atomic
+// store as well : a node keeps all the records of its key, the newest first, so that a read at a sequence number (see Snapshot.go)
+// finds the record it sees.
+
+// The keys and values are copied to an arena : large chunks of memory that are never moved nor reused while the skiplist is used, so
+// a reader never sees them change, and the records don't cost an allocation each.
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"unsafe"
+)
+
+// maxSkipHeight : The maximum number of levels of a node, enough for millions of records.
+const maxSkipHeight = 12
+
+// arenaChunkSize : The size of the chunks of the arena, a larger key or value gets a chunk of its own.
+const arenaChunkSize = 1 << 20
+
+// arena : The memory of the keys and values of a skiplist, only the writer allocates it.
+type arena struct {
+	// The free end of the current chunk.
+	free []byte
+}
+
+// alloc copies s to the arena.
+func (a *arena) alloc(s string) []byte {
+	if len(s) > len(a.free) {
+		if len(s) > arenaChunkSize/4 {
+			return []byte(s)
+		}
+		a.free = make([]byte, arenaChunkSize)
+	}
+	// The capacity is cut, so that the slice never overlaps the next allocation.
+	b := a.free[:len(s):len(s)]
+	copy(b, s)
+	a.free = a.free[len(s):]
+	return b
+}
+
+// skipValue : A record of a key, as stored in a node.
+type skipValue struct {
+	seq uint64
+	// The operation of the record (opSet, opDel or opMerge, see RecordCodec.go).
+	op     byte
+	value  []byte
+	expiry int64
+	// The next older record of the key.
+	older atomic.Pointer[skipValue]
+}
+
+type skipNode struct {
+	key []byte
+	// The newest record of the key.
+	value atomic.Pointer[skipValue]
+	// The next node at each level of the node.
+	next []atomic.Pointer[skipNode]
+}
+
+// SkipList : The sorted records of the main memory, safe for many readers and one writer.
+type SkipList struct {
+	head   *skipNode
+	height atomic.Int32
+	length atomic.Int64
+	// Approximate number of bytes used by the records (see Size).
+	size  atomic.Int64
+	arena *arena
+	// Only used by the writer.
+	rnd *rand.Rand
+}
+
+func NewSkipList() *SkipList {
+	sl := &SkipList{
+		head:  &skipNode{next: make([]atomic.Pointer[skipNode], maxSkipHeight)},
+		arena: &arena{},
+		rnd:   rand.New(rand.NewSource(rand.Int63())),
+	}
+	sl.height.Store(1)
+	return sl
+}
+
+// findGreaterOrEqual returns the first node whose key is not before key, or nil. If prev is not nil, it receives the last node
+// before key at each level.
+func (sl *SkipList) findGreaterOrEqual(key string, prev []*skipNode) *skipNode {
+	x := sl.head
+	for level := int(sl.height.Load()) - 1; level >= 0; level-- {
+		next := x.next[level].Load()
+		for next != nil && string(next.key) < key {
+			x = next
+			next = x.next[level].Load()
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+		if level == 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+// findLessThan returns the last node whose key is before key, or nil. The nodes have no link to the previous one, so going back
+// is a search from the head.
+func (sl *SkipList) findLessThan(key string) *skipNode {
+	x := sl.head
+	for level := int(sl.height.Load()) - 1; level >= 0; level-- {
+		for next := x.next[level].Load(); next != nil && string(next.key) < key; next = x.next[level].Load() {
+			x = next
+		}
+	}
+	if x == sl.head {
+		return nil
+	}
+	return x
+}
+
+// findLast returns the last node, or nil.
+func (sl *SkipList) findLast() *skipNode {
+	x := sl.head
+	for level := int(sl.height.Load()) - 1; level >= 0; level-- {
+		for next := x.next[level].Load(); next != nil; next = x.next[level].Load() {
+			x = next
+		}
+	}
+	if x == sl.head {
+		return nil
+	}
+	return x
+}
+
+// Get returns the newest record of the key, the second value is false if the key is not in the skiplist.
+func (sl *SkipList) Get(key string) (Tuple, bool) {
+	return sl.GetAt(key, latestSeq)
+}
+
+// GetAt returns the newest record of the key whose sequence number is not after seq, the second value is false if there is none.
+func (sl *SkipList) GetAt(key string, seq uint64) (Tuple, bool) {
+	n := sl.findGreaterOrEqual(key, nil)
+	if n == nil || string(n.key) != key {
+		return Tuple{}, false
+	}
+	v := n.valueAt(seq)
+	if v == nil {
+		return Tuple{}, false
+	}
+	return v.tuple(), true
+}
+
+// ReadAt calls add for the records of the key whose sequence number is not after seq, from the newest to the oldest, until add
+// returns false. It returns false if add did.
+func (sl *SkipList) ReadAt(key string, seq uint64, add func(FileRecord) bool) bool {
+	n := sl.findGreaterOrEqual(key, nil)
+	if n == nil || string(n.key) != key {
+		return true
+	}
+	for v := n.valueAt(seq); v != nil; v = v.older.Load() {
+		if !add(v.record(key)) {
+			return false
+		}
+	}
+	return true
+}
+
+// LastSeq returns the sequence number of the newest record of the key, the second value is false if the key is not in the skiplist.
+func (sl *SkipList) LastSeq(key string) (uint64, bool) {
+	n := sl.findGreaterOrEqual(key, nil)
+	if n == nil || string(n.key) != key {
+		return 0, false
+	}
+	return n.value.Load().seq, true
+}
+
+// Set adds a record of the key, written with the sequence number seq. It must only be called by the writer.
+func (sl *SkipList) Set(key string, tp Tuple, seq uint64) {
+	op, _ := opToByte(Operation(tp.operation))
+	v := &skipValue{seq: seq, op: op, value: sl.arena.alloc(tp.value), expiry: tp.expiry}
+
+	var prev [maxSkipHeight]*skipNode
+	n := sl.findGreaterOrEqual(key, prev[:])
+	if n != nil && string(n.key) == key {
+		// The older records stay in the node, a record older than the newest one (see PersMem.thaw) is linked in order.
+		p := n.value.Load()
+		if p.seq <= seq {
+			v.older.Store(p)
+			n.value.Store(v)
+		} else {
+			for o := p.older.Load(); o != nil && o.seq > seq; o = p.older.Load() {
+				p = o
+			}
+			v.older.Store(p.older.Load())
+			p.older.Store(v)
+		}
+		sl.size.Add(int64(skipValueSize + len(tp.value)))
+		return
+	}
+
+	height := sl.randomHeight()
+	if cur := int(sl.height.Load()); height > cur {
+		for level := cur; level < height; level++ {
+			prev[level] = sl.head
+		}
+		// The readers that see the new height before the node find nil links at the new levels, and go down.
+		sl.height.Store(int32(height))
+	}
+
+	n = &skipNode{key: sl.arena.alloc(key), next: make([]atomic.Pointer[skipNode], height)}
+	n.value.Store(v)
+	for level := 0; level < height; level++ {
+		n.next[level].Store(prev[level].next[level].Load())
+		prev[level].next[level].Store(n)
+	}
+	sl.length.Add(1)
+	sl.size.Add(int64(skipNodeSize + height*skipLinkSize + skipValueSize + len(key) + len(tp.value)))
+}
+
+// The memory used by a node besides its key and value, its links, and each record of the node.
+const skipNodeSize = int(unsafe.Sizeof(skipNode{}))
+const skipLinkSize = int(unsafe.Sizeof(atomic.Pointer[skipNode]{}))
+const skipValueSize = int(unsafe.Sizeof(skipValue{}))
+
+// randomHeight returns the number of levels of a new node, each level is kept with a probability of 1/4.
+func (sl *SkipList) randomHeight() int {
+	height := 1
+	for height < maxSkipHeight && sl.rnd.Intn(4) == 0 {
+		height++
+	}
+	return height
+}
+
+// Len returns the number of keys of the skiplist.
+func (sl *SkipList) Len() int {
+	return int(sl.length.Load())
+}
+
+// Size returns the approximate number of bytes used by the skiplist : the keys and values written to it (the values replaced
+// included, they stay in the arena) and the nodes holding them.
+func (sl *SkipList) Size() int64 {
+	return sl.size.Load()
+}
+
+// Clear removes all the records. It must only be called by the writer, the readers in progress may still see the old records.
+func (sl *SkipList) Clear() {
+	for level := range sl.head.next {
+		sl.head.next[level].Store(nil)
+	}
+	sl.height.Store(1)
+	sl.length.Store(0)
+	sl.size.Store(0)
+	sl.arena.free = nil
+}
+
+// valueAt returns the newest record of the node whose sequence number is not after seq, or nil.
+func (n *skipNode) valueAt(seq uint64) *skipValue {
+	v := n.value.Load()
+	for v != nil && v.seq > seq {
+		v = v.older.Load()
+	}
+	return v
+}
+
+func (v *skipValue) tuple() Tuple {
+	op, _ := byteToOp(v.op)
+	return Tuple{string(op), string(v.value), v.expiry}
+}
+
+func (v *skipValue) record(key string) FileRecord {
+	op, _ := byteToOp(v.op)
+	return FileRecord{Operation: op, Key: key, Value: string(v.value), Seq: v.seq, Expiry: v.expiry}
+}
+
+// SkipListIterator : Goes through the records of a skiplist, sorted by key. The records added during the iteration may be seen or not.
+type SkipListIterator struct {
+	sl   *SkipList
+	node *skipNode
+}
+
+func (sl *SkipList) Iterator() *SkipListIterator {
+	return &SkipListIterator{sl: sl, node: sl.head.next[0].Load()}
+}
+
+// Seek returns an iterator on the first record whose key is not before key.
+func (sl *SkipList) Seek(key string) *SkipListIterator {
+	return &SkipListIterator{sl: sl, node: sl.findGreaterOrEqual(key, nil)}
+}
+
+// SeekForPrev returns an iterator on the last record whose key is not after key.
+func (sl *SkipList) SeekForPrev(key string) *SkipListIterator {
+	n := sl.findGreaterOrEqual(key, nil)
+	if n == nil || string(n.key) != key {
+		n = sl.findLessThan(key)
+	}
+	return &SkipListIterator{sl: sl, node: n}
+}
+
+// SeekToLast returns an iterator on the last record.
+func (sl *SkipList) SeekToLast() *SkipListIterator {
+	return &SkipListIterator{sl: sl, node: sl.findLast()}
+}
+
+func (it *SkipListIterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *SkipListIterator) Next() {
+	it.node = it.node.next[0].Load()
+}
+
+// Prev moves the iterator to the previous record, with a search from the head of the skiplist.
+func (it *SkipListIterator) Prev() {
+	it.node = it.sl.findLessThan(string(it.node.key))
+}
+
+func (it *SkipListIterator) Key() string {
+	return string(it.node.key)
+}
+
+// Value returns the newest record of the key.
+func (it *SkipListIterator) Value() Tuple {
+	return it.node.value.Load().tuple()
+}
+
+// Records returns all the records of the key, from the newest to the oldest.
+func (it *SkipListIterator) Records() []FileRecord {
+	var records []FileRecord
+	for v := it.node.value.Load(); v != nil; v = v.older.Load() {
+		records = append(records, v.record(it.Key()))
+	}
+	return records
+}
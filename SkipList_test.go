@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipList(t *testing.T) {
+	sl := NewSkipList()
+	_, ok := sl.Get("Key")
+	assert.False(t, ok)
+	assert.False(t, sl.Iterator().Valid())
+
+	// The keys are added in a random order.
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("Key_%04d", i))
+	}
+	for _, i := range rand.Perm(len(keys)) {
+		sl.Set(keys[i], Tuple{"set", "Value_" + keys[i], 0}, uint64(i+1))
+	}
+	assert.Equal(t, 1000, sl.Len())
+
+	// A key set again keeps a single node, with its older versions.
+	sl.Set("Key_0010", Tuple{"del", "", 0}, 2001)
+	sl.Set("Key_0011", Tuple{"set", "New", 0}, 2002)
+	assert.Equal(t, 1000, sl.Len())
+	v, ok := sl.Get("Key_0010")
+	assert.True(t, ok)
+	assert.Equal(t, Tuple{"del", "", 0}, v)
+	v, ok = sl.Get("Key_0011")
+	assert.True(t, ok)
+	assert.Equal(t, Tuple{"set", "New", 0}, v)
+	_, ok = sl.Get("Key_0010x")
+	assert.False(t, ok)
+	v, ok = sl.GetAt("Key_0011", 2001)
+	assert.True(t, ok)
+	assert.Equal(t, Tuple{"set", "Value_Key_0011", 0}, v)
+	_, ok = sl.GetAt("Key_0011", 0)
+	assert.False(t, ok)
+
+	// The iterator gives the keys in order.
+	var got []string
+	for it := sl.Iterator(); it.Valid(); it.Next() {
+		got = append(got, it.Key())
+	}
+	assert.True(t, sort.StringsAreSorted(got))
+	assert.Equal(t, keys, got)
+
+	// And backward.
+	got = nil
+	for it := sl.SeekToLast(); it.Valid(); it.Prev() {
+		got = append([]string{it.Key()}, got...)
+	}
+	assert.Equal(t, keys, got)
+	assert.Equal(t, "Key_0010", sl.SeekForPrev("Key_0010").Key())
+	assert.Equal(t, "Key_0010", sl.SeekForPrev("Key_0010x").Key())
+	assert.False(t, sl.SeekForPrev("A").Valid())
+
+	// The size counts the keys, the values and the nodes.
+	size := sl.Size()
+	assert.Greater(t, size, int64(1000*(len("Key_0000")+len("Value_Key_0000")+skipNodeSize)))
+	sl.Set("Key_0011", Tuple{"set", "Newer", 0}, 2003)
+	assert.Equal(t, size+int64(skipValueSize+len("Newer")), sl.Size())
+	sl.Clear()
+	assert.Equal(t, 0, sl.Len())
+	assert.Equal(t, int64(0), sl.Size())
+	_, ok = sl.Get("Key_0011")
+	assert.False(t, ok)
+}
+
+func TestSkipListLargeValue(t *testing.T) {
+	sl := NewSkipList()
+	large := string(make([]byte, arenaChunkSize))
+	sl.Set("a", Tuple{"set", large, 0}, 1)
+	sl.Set("b", Tuple{"set", "small", 0}, 2)
+	v, _ := sl.Get("a")
+	assert.Equal(t, large, v.value)
+	v, _ = sl.Get("b")
+	assert.Equal(t, "small", v.value)
+}
+
+func TestSkipListConcurrentReaders(t *testing.T) {
+	sl := NewSkipList()
+	const n = 5000
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// A key found holds one of the values written for it, and the keys are always sorted.
+				k := fmt.Sprintf("Key_%05d", rand.Intn(n))
+				if v, ok := sl.Get(k); ok {
+					assert.Contains(t, []string{"Value_1", "Value_2"}, v.value)
+				}
+				prev := ""
+				for it, i := sl.Iterator(), 0; it.Valid() && i < 100; it.Next() {
+					assert.Less(t, prev, it.Key())
+					prev = it.Key()
+					i++
+				}
+			}
+		}()
+	}
+
+	// A single writer.
+	for _, i := range rand.Perm(n) {
+		sl.Set(fmt.Sprintf("Key_%05d", i), Tuple{"set", "Value_1", 0}, uint64(i+1))
+	}
+	for i := 0; i < n; i += 2 {
+		sl.Set(fmt.Sprintf("Key_%05d", i), Tuple{"set", "Value_2", 0}, uint64(n+i+1))
+	}
+	close(done)
+	wg.Wait()
+	assert.Equal(t, n, sl.Len())
+}
@@ -0,0 +1,118 @@
+package main
+
+// Every write gets a sequence number, increasing across the restarts (see GroupCommit.go) : it is written with the record to the WAL,
+// to the main memory and to the SST files. A read is done at a sequence number, it only sees the records whose sequence number is not
+// after it : a Get or an iterator reads at the sequence number of the last write applied when it starts, so it never sees a part of
+// the writes in progress (a write batch is seen whole or not at all), whatever is flushed or compacted meanwhile.
+
+// A snapshot keeps the sequence number it was taken at, all its reads see the store as it was then. The main memory keeps all the
+// records of a key, and the flushes and the compactions keep the older records read by a live snapshot (see keepRecord) : a
+// snapshot must be released once it isn't used anymore.
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// latestSeq : Reads the newest records.
+const latestSeq uint64 = math.MaxUint64
+
+// Snapshot : A point in time of the store, see above.
+type Snapshot struct {
+	kv  *MyKvStore
+	seq uint64
+}
+
+// snapshotList : The sequence numbers of the live snapshots, a number may be taken by several snapshots.
+type snapshotList struct {
+	mu   sync.Mutex
+	seqs map[uint64]int
+}
+
+func newSnapshotList() *snapshotList {
+	return &snapshotList{seqs: make(map[uint64]int)}
+}
+
+func (l *snapshotList) add(seq uint64) {
+	l.mu.Lock()
+	l.seqs[seq]++
+	l.mu.Unlock()
+}
+
+func (l *snapshotList) remove(seq uint64) {
+	l.mu.Lock()
+	if l.seqs[seq]--; l.seqs[seq] <= 0 {
+		delete(l.seqs, seq)
+	}
+	l.mu.Unlock()
+}
+
+// list returns the sequence numbers of the live snapshots, in order.
+func (l *snapshotList) list() []uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var seqs []uint64
+	for seq := range l.seqs {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// keepRecord reports whether a flush or a compaction keeps a record of a key, given the sequence number of the next newer record of
+// the key (latestSeq for the newest record) : the newest record is always kept, an older one only if a snapshot taken between the
+// two writes reads it.
+func keepRecord(seq, newer uint64, snapshots []uint64) bool {
+	if newer == latestSeq {
+		return true
+	}
+	i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i] >= seq })
+	return i < len(snapshots) && snapshots[i] < newer
+}
+
+// snapshotBefore reports whether a snapshot was taken before the write of seq, it may read the older records of the key.
+func snapshotBefore(seq uint64, snapshots []uint64) bool {
+	return len(snapshots) > 0 && snapshots[0] < seq
+}
+
+// GetSnapshot returns a snapshot of the store as it is now, it must be released.
+func (kv *MyKvStore) GetSnapshot() *Snapshot {
+	// The locks keep the flushes from taking the main memory, and the compactions from being picked, before the snapshot is listed.
+	kv.sstM.mu.RLock()
+	defer kv.sstM.mu.RUnlock()
+	kv.memDB.mu.RLock()
+	defer kv.memDB.mu.RUnlock()
+
+	s := &Snapshot{kv: kv, seq: kv.memDB.lastSeq()}
+	kv.sstM.snapshots.add(s.seq)
+	return s
+}
+
+// Get returns the value the key had when the snapshot was taken.
+func (s *Snapshot) Get(key string) (string, error) {
+	return s.kv.get(key, s.seq)
+}
+
+// NewIterator returns an iterator on the records of [start, end) when the snapshot was taken (see Iterator.go).
+func (s *Snapshot) NewIterator(start, end string) (*Iterator, error) {
+	return s.kv.newIterator(start, end, s.seq)
+}
+
+// ScanPrefix returns an iterator on the records whose keys start with prefix when the snapshot was taken.
+func (s *Snapshot) ScanPrefix(prefix string) (*Iterator, error) {
+	return s.kv.newIterator(prefix, prefixEnd(prefix), s.seq)
+}
+
+// Seq returns the sequence number of the last write seen by the snapshot.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Release lets the flushes and the compactions drop the records only read by the snapshot, it must not be used afterwards.
+func (s *Snapshot) Release() {
+	if s.kv != nil {
+		s.kv.sstM.snapshots.remove(s.seq)
+		s.kv = nil
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+
+	for k := 0; k < 100; k++ {
+		assert.NoError(t, kv.Set(fmt.Sprintf("Key_%03d", k), "Old"))
+	}
+	snap := kv.GetSnapshot()
+	defer snap.Release()
+
+	// The writes after the snapshot overwrite, delete and add keys.
+	for k := 0; k < 100; k += 2 {
+		assert.NoError(t, kv.Set(fmt.Sprintf("Key_%03d", k), "New"))
+	}
+	for k := 0; k < 100; k += 3 {
+		_, err := kv.Del(fmt.Sprintf("Key_%03d", k))
+		assert.NoError(t, err)
+	}
+	b := NewWriteBatch()
+	b.Put("Key_100", "New")
+	b.Delete("Key_001")
+	assert.NoError(t, kv.Write(b))
+
+	check := func() {
+		for k := 0; k < 100; k++ {
+			v, err := snap.Get(fmt.Sprintf("Key_%03d", k))
+			assert.NoError(t, err)
+			assert.Equal(t, "Old", v)
+		}
+		_, err := snap.Get("Key_100")
+		assert.Error(t, err)
+
+		it, err := snap.ScanPrefix("Key_")
+		assert.NoError(t, err)
+		n := 0
+		for ; it.Valid(); it.Next() {
+			assert.Equal(t, fmt.Sprintf("Key_%03d", n), it.Key())
+			assert.Equal(t, "Old", it.Value())
+			n++
+		}
+		assert.NoError(t, it.Err())
+		it.Close()
+		assert.Equal(t, 100, n)
+
+		// The store itself sees the newest records.
+		_, err = kv.Get("Key_000")
+		assert.Error(t, err)
+		v, err := kv.Get("Key_002")
+		assert.NoError(t, err)
+		assert.Equal(t, "New", v)
+		v, err = kv.Get("Key_100")
+		assert.NoError(t, err)
+		assert.Equal(t, "New", v)
+	}
+	check()
+
+	// The records read by the snapshot are kept by the flushes and the compactions.
+	for i := 0; i < 3000; i++ {
+		assert.NoError(t, kv.Set(fmt.Sprintf("Filler_%04d", i), strings.Repeat("v", 100)))
+	}
+	kv.flushes.Wait()
+	waitCompactions(kv.sstM)
+	assert.Greater(t, len(kv.sstM.metas()), 1)
+	check()
+}
+
+// compactTestFiles compacts two files written with the given records to L1, and returns the key and the sequence number of the
+// records written.
+func compactTestFiles(t *testing.T, newer, older []FileRecord, snapshots []uint64) []string {
+	chdirTemp(t)
+	m, err := NewSSTManager(defLoad, treshold)
+	assert.NoError(t, err)
+	defer m.manifest.Close()
+
+	old := addTestFile(t, m, older)
+	c := &compaction{inputs: []fileMeta{addTestFile(t, m, newer), old}, outputLevel: 1, maxOutputSize: maxFileSize, snapshots: snapshots}
+	assert.NoError(t, m.compact(c, nil))
+	files := levelFiles(m.metas(), 1)
+	assert.Equal(t, 1, len(files))
+	var got []string
+	for _, r := range readTestSSTFile(t, files[0].Num) {
+		got = append(got, fmt.Sprintf("%s%d", r.Key, r.Seq))
+	}
+	return got
+}
+
+func TestCompactionKeepsSnapshotRecords(t *testing.T) {
+	newer := []FileRecord{
+		{Operation: Put, Key: "a", Value: "a10", Seq: 10},
+		{Operation: Del, Key: "b", Seq: 11},
+		{Operation: Put, Key: "d", Value: "d8", Seq: 8},
+		{Operation: Del, Key: "e", Seq: 7},
+	}
+	older := []FileRecord{
+		{Operation: Put, Key: "a", Value: "a5", Seq: 5},
+		{Operation: Put, Key: "a", Value: "a3", Seq: 3},
+		{Operation: Put, Key: "b", Value: "b4", Seq: 4},
+		{Operation: Put, Key: "d", Value: "d6", Seq: 6},
+		{Operation: Del, Key: "f", Seq: 3},
+	}
+
+	// The snapshots taken at 4 and 9 read a5, a3, b4 and the deletion of e. d6 is read by none, and no snapshot reads a record of f
+	// older than its deletion.
+	got := compactTestFiles(t, newer, older, []uint64{4, 9})
+	assert.Equal(t, []string{"a10", "a5", "a3", "b11", "b4", "d8", "e7"}, got)
+
+	// Without snapshots, only the newest records are kept, and the deletions dropped.
+	got = compactTestFiles(t, newer, older, nil)
+	assert.Equal(t, []string{"a10", "d8"}, got)
+}
+
+func TestCompactionKeepsKeyInOneFile(t *testing.T) {
+	chdirTemp(t)
+	m, err := NewSSTManager(defLoad, treshold)
+	assert.NoError(t, err)
+	defer m.manifest.Close()
+
+	old := addTestFile(t, m, []FileRecord{
+		{Operation: Put, Key: "a", Value: "a1", Seq: 1},
+		{Operation: Put, Key: "k", Value: "Old", Seq: 2},
+	})
+	newer := addTestFile(t, m, []FileRecord{
+		{Operation: Put, Key: "k", Value: "New", Seq: 10},
+		{Operation: Put, Key: "z", Value: "z11", Seq: 11},
+	})
+
+	// Every file is full after its first record, the snapshot keeps both records of k : they are written to the same file.
+	c := &compaction{inputs: []fileMeta{newer, old}, outputLevel: 1, maxOutputSize: 1, snapshots: []uint64{5}}
+	assert.NoError(t, m.compact(c, nil))
+	assert.Equal(t, 3, len(levelFiles(m.metas(), 1)))
+	checkLevels(t, m)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, err := m.searchAt("k", latestSeq)
+	assert.NoError(t, err)
+	assert.Equal(t, "New", v)
+	v, err = m.searchAt("k", 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "Old", v)
+}
+
+func TestKeepRecord(t *testing.T) {
+	snapshots := []uint64{4, 9}
+	assert.True(t, keepRecord(12, latestSeq, nil))
+	assert.False(t, keepRecord(5, 12, nil))
+	assert.True(t, keepRecord(4, 5, snapshots))
+	assert.True(t, keepRecord(5, 10, snapshots))
+	assert.False(t, keepRecord(5, 9, snapshots))
+	assert.False(t, keepRecord(10, 12, snapshots))
+	assert.True(t, snapshotBefore(5, snapshots))
+	assert.False(t, snapshotBefore(4, snapshots))
+}
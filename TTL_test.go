@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTTL(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+
+	assert.NoError(t, kv.Set("a", "Old"))
+	assert.NoError(t, kv.SetWithTTL("a", "New", 200*time.Millisecond))
+	assert.NoError(t, kv.SetWithTTL("b", "1", time.Hour))
+	assert.NoError(t, kv.Set("c", "1"))
+	v, err := kv.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "New", v)
+
+	// An expired value is missing, the older value of the key is not read.
+	check := func() {
+		_, err := kv.Get("a")
+		assert.EqualError(t, err, "Key Not Found")
+		v, err := kv.Get("b")
+		assert.NoError(t, err)
+		assert.Equal(t, "1", v)
+
+		var keys []string
+		it, err := kv.NewIterator("a", "d")
+		assert.NoError(t, err)
+		for ; it.Valid(); it.Next() {
+			keys = append(keys, it.Key())
+		}
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			keys = append(keys, it.Key())
+		}
+		it.Close()
+		assert.Equal(t, []string{"b", "c", "c", "b"}, keys)
+	}
+	time.Sleep(250 * time.Millisecond)
+	check()
+
+	// The expiry is kept in the SST files.
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, kv.Set(fmt.Sprintf("Filler_%04d", i), strings.Repeat("v", 100)))
+	}
+	kv.flushes.Wait()
+	_, found := kv.memDB.lastWrite("a")
+	assert.False(t, found)
+	check()
+}
+
+func TestTTLReplay(t *testing.T) {
+	dir := t.TempDir()
+	mem := openTestPersMem(t, dir)
+	expiry := time.Now().Add(time.Hour).UnixNano()
+	assert.NoError(t, mem.SetExpiringM("a", "1", expiry))
+	mem.Close()
+
+	// The expiry is kept in the WAL.
+	mem = openTestPersMem(t, dir)
+	assert.NoError(t, mem.Load())
+	v, err := mem.GetM("a")
+	assert.NoError(t, err)
+	assert.Equal(t, Tuple{"set", "1", expiry}, v)
+}
+
+func TestCompactionDropsExpired(t *testing.T) {
+	past := time.Now().Add(-time.Minute).UnixNano()
+	future := time.Now().Add(time.Hour).UnixNano()
+	newer := []FileRecord{
+		{Operation: Put, Key: "a", Value: "a3", Seq: 3, Expiry: past},
+		{Operation: Put, Key: "b", Value: "b4", Seq: 4, Expiry: future},
+	}
+	older := []FileRecord{
+		{Operation: Put, Key: "a", Value: "a1", Seq: 1},
+		{Operation: Put, Key: "c", Value: "c2", Seq: 2, Expiry: past},
+	}
+
+	// The expired values are dropped with the older records of their keys.
+	got := compactTestFiles(t, newer, older, nil)
+	assert.Equal(t, []string{"b4"}, got)
+
+	// A snapshot taken before the expired value still reads the older one, the expired value is kept as a deletion.
+	got = compactTestFiles(t, newer, older, []uint64{2})
+	assert.Equal(t, []string{"a3", "a1", "b4"}, got)
+}
+
+func TestCompactedExpiryReadsAsMissing(t *testing.T) {
+	chdirTemp(t)
+	m, err := NewSSTManager(defLoad, treshold)
+	assert.NoError(t, err)
+	defer m.manifest.Close()
+
+	// The snapshot keeps the expired value as a deletion.
+	past := time.Now().Add(-time.Minute).UnixNano()
+	old := addTestFile(t, m, []FileRecord{{Operation: Put, Key: "a", Value: "a1", Seq: 1}})
+	newer := addTestFile(t, m, []FileRecord{{Operation: Put, Key: "a", Value: "a3", Seq: 3, Expiry: past}})
+	m.mu.RLock()
+	_, err = m.searchAt("a", latestSeq)
+	m.mu.RUnlock()
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	c := &compaction{inputs: []fileMeta{newer, old}, outputLevel: 1, maxOutputSize: maxFileSize, snapshots: []uint64{2}}
+	assert.NoError(t, m.compact(c, nil))
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, err = m.searchAt("a", latestSeq)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	v, err := m.searchAt("a", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "a1", v)
+}
+
+func TestHTTPSetTTL(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+	api := &HTTP_API_DB{db: kv}
+	server := httptest.NewServer(http.HandlerFunc(api.HandleSet))
+	defer server.Close()
+
+	post := func(query string) int {
+		resp, err := http.Post(server.URL+"/set?"+query, "", nil)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusBadRequest, post("key=a&value=1&ttl=soon"))
+	assert.Equal(t, http.StatusBadRequest, post("key=a&value=1&ttl=0"))
+	assert.Equal(t, http.StatusNoContent, post("key=a&value=1&ttl=3600"))
+	v, err := kv.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", v)
+	T, found := kv.memDB.get("a")
+	assert.True(t, found)
+	assert.Greater(t, T.expiry, time.Now().Add(59*time.Minute).UnixNano())
+}
@@ -2,16 +2,25 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"os"
+	"sort"
 	"sync"
-
-	"github.com/igrmk/treemap/v2"
+	"sync/atomic"
 )
 
-// Tuple : <string, string>
+// Tuple : <string, string, int64>
 type Tuple struct {
 	operation string
 	value     string
+	// Time the value expires at (Unix nanoseconds), 0 for a value that never expires.
+	expiry int64
+}
+
+// expired reports whether the tuple is a value expired at now.
+func (t Tuple) expired(now int64) bool {
+	return t.operation == "set" && t.expiry != 0 && t.expiry <= now
 }
 
 type PersistentCacheMemory interface {
@@ -22,77 +31,352 @@ type PersistentCacheMemory interface {
 	SetM(string, string) error
 }
 
-// Use as default name : mydb.wal
+// The WAL is split in numbered segments (WALFiles/WAL<n>.wal), the records are appended to the newest one.
+// A new segment is started when the main memory is flushed to an SST file, the older segments are deleted once the SST file is
+// on the disk. The segments that still exist are the live ones, they hold the records of the main memory and are replayed by Load.
+
+// When the main memory is full it is frozen : it becomes the immutable memory, still searched by GetM while it is written to an SST
+// file in the background, and the writes go to a new main memory and a new segment at once.
+
+// The main memory is a skiplist (see SkipList.go), written only by the commit leader and read without locks.
 type PersMem struct {
+	// Protects the store and imm pointers, they are switched by freeze while GetM and the flush read them.
 	mu    sync.RWMutex
-	store *treemap.TreeMap[string, Tuple]
-	wal   *WALFile
+	store *SkipList
+	// The frozen main memory being written to an SST file, nil when no flush is in progress. Its records are older than the ones
+	// of store.
+	imm *SkipList
+	wal *WALFile
+	// Queue of the writes waiting for the group commit.
+	cq *commitQueue
+	// Number of bytes of torn record dropped from the end of the WAL by the last Load.
+	droppedBytes int64
+
+	// Directory of the WAL segments.
+	dir  string
+	opts Options
+	// Number of the segment the records are appended to.
+	walNum uint64
+	// Segments holding the records of the main memory, in order, the last one is walNum.
+	live []uint64
+	// Sequence number of the last record written, the records get increasing numbers across the restarts (see Snapshot.go).
+	seq uint64
+	// Sequence number of the last record applied to the main memory, the reads see the records up to it.
+	visible atomic.Uint64
 }
 
 func NewPersMem() (*PersMem, error) {
-	nw, err := NewWALFile(WalName)
-	nw.SeekEnd()
-	nw1 := treemap.New[string, Tuple]()
+	return newPersMem(walDirectory, DefaultOptions())
+}
+
+// newPersMem creates the main memory backed by the WAL segments of dir, synced as required by opts.Durability.
+// The records are appended to a new segment, the existing ones are replayed by Load.
+func newPersMem(dir string, opts Options) (*PersMem, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	live, err := listSegments(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	inst := PersMem{wal: nw, store: nw1}
+	walNum := uint64(1)
+	if len(live) > 0 {
+		walNum = live[len(live)-1] + 1
+	}
+	nw, err := openSegment(dir, walNum, opts)
+	if err != nil {
+		return nil, err
+	}
+	nw1 := NewSkipList()
+
+	inst := PersMem{wal: nw, store: nw1, cq: newCommitQueue(), dir: dir, opts: opts, walNum: walNum, live: append(live, walNum)}
 	return &inst, nil
 }
 
-// Checks if WAL is empty, if not loads all records to main memory.
+func segmentName(dir string, num uint64) string {
+	return fmt.Sprintf("%s/WAL%d.wal", dir, num)
+}
+
+func openSegment(dir string, num uint64, opts Options) (*WALFile, error) {
+	nw, err := NewWALFile(segmentName(dir, num))
+	if err != nil {
+		return nil, err
+	}
+	nw.SeekEnd()
+	nw.SetDurability(opts.Durability, opts.SyncInterval)
+	return nw, nil
+}
+
+// listSegments returns the numbers of the WAL segments of dir, in order.
+func listSegments(dir string) ([]uint64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var nums []uint64
+	for _, file := range files {
+		var num uint64
+		if n, _ := fmt.Sscanf(file.Name(), "WAL%d.wal", &num); n == 1 && file.Name() == fmt.Sprintf("WAL%d.wal", num) {
+			nums = append(nums, num)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
+}
+
+// adoptLegacyWAL moves the WAL written before the segments (mydb.wal) to dir, as its newest segment.
+func adoptLegacyWAL(name string, dir string) error {
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	nums, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	num := uint64(1)
+	if len(nums) > 0 {
+		num = nums[len(nums)-1] + 1
+	}
+	fmt.Printf("Moving %s to %s\n", name, segmentName(dir, num))
+	return os.Rename(name, segmentName(dir, num))
+}
+
+// Checks if the WAL segments are empty, if not loads all records to main memory.
 // Records are loaded sequentially, therefore there is no risk.
+// A torn record at the end of the WAL (crash in the middle of a write) is dropped, the number of bytes dropped is kept in droppedBytes.
+// A corrupted record in the middle of the WAL makes Load fail with an ErrCorruption, a torn record followed by records in a newer
+// segment is such a corruption.
 func (s *PersMem) Load() error {
-	s.wal.SeekStart()
+	s.droppedBytes = 0
+	var tornIn string
+
+	for _, num := range s.live {
+		wal := s.wal
+		if num != s.walNum {
+			var err error
+			if wal, err = NewWALFile(segmentName(s.dir, num)); err != nil {
+				return err
+			}
+		}
+
+		n, err := s.loadSegment(wal)
+		if wal != s.wal {
+			wal.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if tornIn != "" && n > 0 {
+			return &ErrCorruption{File: tornIn, Offset: 0, Reason: "torn record followed by newer WAL segments"}
+		}
+		if s.droppedBytes > 0 && tornIn == "" {
+			tornIn = segmentName(s.dir, num)
+		}
+	}
+	s.visible.Store(s.seq)
+	return nil
+}
+
+// lastSeq returns the sequence number of the last record applied, see Snapshot.go.
+func (s *PersMem) lastSeq() uint64 {
+	return s.visible.Load()
+}
+
+// loadSegment replays the records of a segment and returns the number of records loaded.
+func (s *PersMem) loadSegment(wal *WALFile) (int, error) {
+	wal.SeekStart()
 
 	tp := Tuple{}
+	n := 0
 	for {
-		r, err := s.wal.ReadRecord()
+		r, err := wal.ReadRecord()
 
 		// We have reached the end of the Wal File and all values have been loaded.
 		if err == io.EOF {
-			return nil
+			return n, nil
+		}
+		// The last record was being written during a crash, everything before it has been loaded.
+		if err == errTornRecord {
+			dropped, err := wal.DropTornTail()
+			if err != nil {
+				return n, err
+			}
+			s.droppedBytes += dropped
+			fmt.Printf("Dropped a torn record at the end of the WAL file %s (%d bytes)\n", wal.file.Name(), dropped)
+			return n, nil
 		}
 		// Some error occured.
 		if err != nil {
-			return err
+			return n, err
+		}
+		n++
+		// The segments written before the sequence numbers number their records in order.
+		s.seq++
+		if r.Seq != 0 {
+			s.seq = r.Seq
 		}
-
-		// use a switch instead
 
 		switch r.Operation {
 		case "set":
 			tp.operation = "set"
 			tp.value = r.Value
+			tp.expiry = r.Expiry
 
 			// Put a copy of the record in the main memory.
-			s.store.Set(r.Key, tp)
+			s.store.Set(r.Key, tp, s.seq)
 
 		case "del":
 			tp.operation = "del"
 			tp.value = ""
+			tp.expiry = 0
+
+			// Put a copy of the record in the main memory.
+			s.store.Set(r.Key, tp, s.seq)
+
+		case "merge":
+			tp.operation = "merge"
+			tp.value = r.Value
+			tp.expiry = 0
 
 			// Put a copy of the record in the main memory.
-			s.store.Set(r.Key, tp)
+			s.store.Set(r.Key, tp, s.seq)
 		}
+	}
+}
 
-		/*
-			if r.Operation == "set" {
-				tp.operation = "set"
-				tp.value = r.Value
+// freeze makes the main memory immutable and starts a new one, with a new segment (see switchSegment). The switch goes through the
+// group commit, so that no write is in progress. There must be no immutable memory already.
+func (s *PersMem) freeze() ([]uint64, uint64, error) {
+	var old []uint64
+	var seq uint64
+	err := s.commitAlone(func() error {
+		var err error
+		if old, seq, err = s.switchSegment(); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.imm = s.store
+		s.store = NewSkipList()
+		s.mu.Unlock()
+		return nil
+	})
+	return old, seq, err
+}
 
-				s.store.Set(r.Key, tp)
-				//fmt.Printf("restored")
-			}
-			if r.Operation == "del" {
-				tp.operation = "del"
-				tp.value = ""
-				s.store.Set(r.Key, tp)
-				//fmt.Printf("restored")
+// switchSegment syncs the current segment and starts a new one, it returns the segments that hold the records written so far, and
+// the sequence number of the last of these records. It must be called by the commit leader, alone.
+func (s *PersMem) switchSegment() ([]uint64, uint64, error) {
+	nw, err := openSegment(s.dir, s.walNum+1, s.opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := s.wal.Close(); err != nil {
+		nw.Close()
+		return nil, 0, err
+	}
+	if err := syncDir(s.dir); err != nil {
+		nw.Close()
+		return nil, 0, err
+	}
+	s.wal = nw
+	s.walNum++
+	old := s.live
+	s.live = []uint64{s.walNum}
+	return old, s.seq, nil
+}
+
+// dropImmutable forgets the immutable memory, once its records are searched in the SST file they were written to.
+func (s *PersMem) dropImmutable() {
+	s.mu.Lock()
+	s.imm = nil
+	s.mu.Unlock()
+}
+
+// thaw puts the records of the immutable memory back in the main memory, when they could not be written to an SST file.
+// The records of the main memory are newer, the older ones are linked after them. The records are put through the group commit, the
+// only writer of the main memory.
+func (s *PersMem) thaw() {
+	s.commitAlone(func() error {
+		if s.imm == nil {
+			return nil
+		}
+		for it := s.imm.Iterator(); it.Valid(); it.Next() {
+			for _, r := range it.Records() {
+				s.store.Set(r.Key, Tuple{string(r.Operation), r.Value, r.Expiry}, r.Seq)
 			}
-		*/
+		}
+		s.mu.Lock()
+		s.imm = nil
+		s.mu.Unlock()
+		return nil
+	})
+}
+
+// Size returns the approximate number of bytes used by the main memory (the immutable memory excluded).
+func (s *PersMem) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.Size()
+}
+
+// Len returns the number of records of the main memory (the immutable memory excluded).
+func (s *PersMem) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.Len()
+}
+
+// keepSegments puts back the segments returned by freeze, when their records could not be written to an SST file.
+func (s *PersMem) keepSegments(nums []uint64) {
+	s.commitAlone(func() error {
+		s.live = append(nums, s.live...)
+		return nil
+	})
+}
+
+// dropSegments deletes the given segments, their records must be on the disk in an SST file.
+func (s *PersMem) dropSegments(nums []uint64) error {
+	for _, num := range nums {
+		if err := os.Remove(segmentName(s.dir, num)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
+	return nil
+}
+
+// skipSegments deletes the segments numbered below logNum, their records are already in the SST files.
+// It must be called before the first write.
+func (s *PersMem) skipSegments(logNum uint64) error {
+	// The records appended from now on must not be skipped on the next start.
+	if s.walNum < logNum {
+		nw, err := openSegment(s.dir, logNum, s.opts)
+		if err != nil {
+			return err
+		}
+		s.wal.Close()
+		if err := os.Remove(segmentName(s.dir, s.walNum)); err != nil {
+			nw.Close()
+			return err
+		}
+		s.wal = nw
+		s.walNum = logNum
+		s.live = append(s.live[:len(s.live)-1], logNum)
+	}
+
+	var live, skipped []uint64
+	for _, num := range s.live {
+		if num < logNum {
+			skipped = append(skipped, num)
+		} else {
+			live = append(live, num)
+		}
+	}
+	s.live = live
+	return s.dropSegments(skipped)
 }
 
 func (s *PersMem) Close() error {
@@ -106,31 +390,85 @@ func (s *PersMem) Close() error {
 }
 
 func (s *PersMem) GetM(key string) (Tuple, error) {
-	// In this Phase we only need to retrieve the key if it could be found in the main memory.
-	v, b := s.store.Get(key)
+	v, b := s.getAt(key, s.lastSeq())
 	if b == false {
-		return Tuple{"", ""}, errors.New("Key Not found In MemDB")
+		return Tuple{"", "", 0}, errors.New("Key Not found In MemDB")
 	}
 	return v, nil
 }
 
+// get looks for the newest record of the key.
+func (s *PersMem) get(key string) (Tuple, bool) {
+	return s.getAt(key, latestSeq)
+}
+
+// getAt looks for the newest record of the key whose sequence number is not after seq, in the main memory, then in the immutable
+// memory.
+func (s *PersMem) getAt(key string, seq uint64) (Tuple, bool) {
+	s.mu.RLock()
+	store, imm := s.store, s.imm
+	s.mu.RUnlock()
+
+	if v, ok := store.GetAt(key, seq); ok {
+		return v, true
+	}
+	if imm != nil {
+		return imm.GetAt(key, seq)
+	}
+	return Tuple{}, false
+}
+
+// readAt calls add for the records of the key whose sequence number is not after seq, from the newest to the oldest, in the main
+// memory then in the immutable memory, until add returns false. It returns false if add did.
+func (s *PersMem) readAt(key string, seq uint64, add func(FileRecord) bool) bool {
+	s.mu.RLock()
+	store, imm := s.store, s.imm
+	s.mu.RUnlock()
+
+	if !store.ReadAt(key, seq, add) {
+		return false
+	}
+	return imm == nil || imm.ReadAt(key, seq, add)
+}
+
+// lastWrite returns the sequence number of the newest record of the key in the main memory or the immutable memory, the second value
+// is false if neither holds the key.
+func (s *PersMem) lastWrite(key string) (uint64, bool) {
+	s.mu.RLock()
+	store, imm := s.store, s.imm
+	s.mu.RUnlock()
+
+	if seq, ok := store.LastSeq(key); ok {
+		return seq, true
+	}
+	if imm != nil {
+		return imm.LastSeq(key)
+	}
+	return 0, false
+}
+
+// SetM writes the record through the group commit (see GroupCommit.go).
 func (s *PersMem) SetM(key string, val string) error {
+	return s.SetExpiringM(key, val, 0)
+}
+
+// SetExpiringM writes the record as SetM does, its value expires at expiry (Unix nanoseconds, 0 if it never expires).
+func (s *PersMem) SetExpiringM(key string, val string, expiry int64) error {
 	//Create The record to be added to the WAL first
-	s.wal.SeekEnd()
 	r := FileRecord{
 		Operation: "set",
 		Key:       key,
 		Value:     val,
+		Expiry:    expiry,
 	}
-	err := s.wal.WriteRecord(r)
-	if err != nil {
-		return err
-	}
-
-	//Add the KV-pair to the main memory.
-	tp := Tuple{"set", val}
-	s.store.Set(key, tp)
-	return nil
+	// The leader gives the record its sequence number.
+	records := []FileRecord{r}
+	return s.commit(records, func() error {
+		//Add the KV-pair to the main memory.
+		tp := Tuple{"set", val, expiry}
+		s.store.Set(key, tp, records[0].Seq)
+		return nil
+	})
 }
 
 func (s *PersMem) DelM(key string) (string, error) {
@@ -141,24 +479,30 @@ func (s *PersMem) DelM(key string) (string, error) {
 		Key:       key,
 		Value:     "",
 	}
-	err := s.wal.WriteRecord(r)
+
+	var old string
+	records := []FileRecord{r}
+	err := s.commit(records, func() error {
+		// In this Phase we only need to retrieve the key if it could be found in the main memory.
+		val, b := s.get(key)
+
+		// The deletion is in the WAL, the main memory must hold it too.
+		tp := Tuple{"del", "", 0}
+		s.store.Set(key, tp, records[0].Seq)
+
+		if !b {
+			return ErrKeyNotFound
+		}
+		if val.operation == "del" {
+			return ErrKeyDeleted
+		}
+		old = val.value
+		return nil
+	})
 	if err != nil {
 		return "", err
 	}
-
-	// In this Phase we only need to retrieve the key if it could be found in the main memory.
-	val, b := s.store.Get(key)
-	if !b {
-		return "", errors.New("Key Not Found")
-	}
-	if val.operation == "del" {
-		return "", errors.New("Key Deleted")
-	}
-
-	//Add the KV-pair to the main memory.
-	tp := Tuple{"del", ""}
-	s.store.Set(key, tp)
-	return val.value, nil
+	return old, nil
 }
 
 func (s *PersMem) DelM1(key string) error {
@@ -168,23 +512,52 @@ func (s *PersMem) DelM1(key string) error {
 		Key:       key,
 		Value:     "",
 	}
-	err := s.wal.WriteRecord(r)
-	if err != nil {
-		return err
-	}
+	records := []FileRecord{r}
+	return s.commit(records, func() error {
+		tp := Tuple{"del", "", 0}
+		s.store.Set(key, tp, records[0].Seq)
+		return nil
+	})
+}
 
-	tp := Tuple{"del", ""}
-	s.store.Set(key, tp)
+// SetIf writes the value of the key if check succeeds, no other write is applied between check and the write.
+func (s *PersMem) SetIf(key string, val string, check func() error) error {
+	r := FileRecord{
+		Operation: "set",
+		Key:       key,
+		Value:     val,
+	}
+	records := []FileRecord{r}
+	return s.commitChecked(records, check, func() error {
+		tp := Tuple{"set", val, 0}
+		s.store.Set(key, tp, records[0].Seq)
+		return nil
+	})
+}
 
-	return nil
+// DelIf writes the deletion of the key if check succeeds, no other write is applied between check and the deletion.
+func (s *PersMem) DelIf(key string, check func() error) error {
+	r := FileRecord{
+		Operation: "del",
+		Key:       key,
+		Value:     "",
+	}
+	records := []FileRecord{r}
+	return s.commitChecked(records, check, func() error {
+		tp := Tuple{"del", "", 0}
+		s.store.Set(key, tp, records[0].Seq)
+		return nil
+	})
 }
 
+// Clear empties the main memory and drops all the WAL segments written so far.
 func (s *PersMem) Clear() error {
-	if err := s.wal.ResetWal(); err != nil {
+	old, _, err := s.freeze()
+	if err != nil {
 		return err
 	}
-	s.store.Clear()
-	return nil
+	s.dropImmutable()
+	return s.dropSegments(old)
 }
 
 /* func main() {
@@ -0,0 +1,121 @@
+package main
+
+// An optimistic transaction reads the store as it was when it began (as a snapshot, see Snapshot.go) and keeps its writes in a write
+// batch, seen by its own reads. Commit writes the batch through the group commit, after the leader has checked that none of the keys
+// read by the transaction was written since it began : otherwise nothing is written and ErrConflict is returned, the transaction
+// can be run again from Begin.
+
+import (
+	"errors"
+)
+
+// ErrConflict : A key read by the transaction was written by another write after the transaction began.
+var ErrConflict = errors.New("Transaction Conflict")
+
+var errTxnDone = errors.New("Transaction Done")
+
+// Txn : A transaction, see above. It must be committed or discarded, and not used by several goroutines at once.
+type Txn struct {
+	kv     *MyKvStore
+	snap   *Snapshot
+	writes *WriteBatch
+	// Index in writes of the last write of each key.
+	written map[string]int
+	// Keys read from the store, checked by Commit.
+	reads map[string]struct{}
+}
+
+// Begin starts a transaction.
+func (kv *MyKvStore) Begin() *Txn {
+	return &Txn{
+		kv:      kv,
+		snap:    kv.GetSnapshot(),
+		writes:  NewWriteBatch(),
+		written: make(map[string]int),
+		reads:   make(map[string]struct{}),
+	}
+}
+
+// Get returns the value the transaction wrote to the key, or else the value the key had when the transaction began.
+func (t *Txn) Get(key string) (string, error) {
+	if t.snap == nil {
+		return "", errTxnDone
+	}
+	if i, ok := t.written[key]; ok {
+		r := t.writes.records[i]
+		if r.Operation == Del {
+			return "", ErrKeyDeleted
+		}
+		return r.Value, nil
+	}
+	t.reads[key] = struct{}{}
+	return t.snap.Get(key)
+}
+
+// Set writes the value of the key when the transaction is committed.
+func (t *Txn) Set(key string, val string) error {
+	if t.snap == nil {
+		return errTxnDone
+	}
+	t.written[key] = t.writes.Len()
+	t.writes.Put(key, val)
+	return nil
+}
+
+// Del deletes the key when the transaction is committed.
+func (t *Txn) Del(key string) error {
+	if t.snap == nil {
+		return errTxnDone
+	}
+	t.written[key] = t.writes.Len()
+	t.writes.Delete(key)
+	return nil
+}
+
+// Commit writes all the writes of the transaction at once, or returns ErrConflict without writing any. A transaction that wrote
+// nothing only read a consistent state of the store, it is never in conflict. The transaction is done afterwards.
+func (t *Txn) Commit() error {
+	if t.snap == nil {
+		return errTxnDone
+	}
+	defer t.Discard()
+	if t.writes.Len() == 0 {
+		return nil
+	}
+
+	defer t.kv.CheckIfFlush()
+	return t.kv.memDB.WriteIf(t.writes, func() error {
+		return t.kv.checkConflicts(t.reads, t.snap.seq)
+	})
+}
+
+// Discard drops the writes of the transaction, it is done afterwards. Discarding a committed transaction does nothing.
+func (t *Txn) Discard() {
+	if t.snap != nil {
+		t.snap.Release()
+		t.snap = nil
+	}
+}
+
+// checkConflicts returns ErrConflict if one of the keys was written after seq. It is called by the commit leader, every write
+// before the transaction is applied.
+func (kv *MyKvStore) checkConflicts(keys map[string]struct{}, seq uint64) error {
+	// The files are kept while the main memory is searched, as by get.
+	kv.sstM.mu.RLock()
+	defer kv.sstM.mu.RUnlock()
+
+	for key := range keys {
+		last, found := kv.memDB.lastWrite(key)
+		written := found && last > seq
+		if !found {
+			var err error
+			if written, err = kv.sstM.writtenAfter(key, seq); err != nil {
+				return err
+			}
+		}
+		if written {
+			return ErrConflict
+		}
+	}
+	return nil
+}
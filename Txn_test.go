@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxn(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+	assert.NoError(t, kv.Set("a", "1"))
+	assert.NoError(t, kv.Set("b", "1"))
+
+	// The transaction sees its own writes, the other reads see none of them before the commit.
+	txn := kv.Begin()
+	v, err := txn.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", v)
+	assert.NoError(t, txn.Set("a", "2"))
+	assert.NoError(t, txn.Del("b"))
+	assert.NoError(t, txn.Set("c", "2"))
+	v, err = txn.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", v)
+	_, err = txn.Get("b")
+	assert.Error(t, err)
+	v, err = kv.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", v)
+
+	// A write of a key the transaction didn't read is no conflict.
+	assert.NoError(t, kv.Set("d", "1"))
+	assert.NoError(t, txn.Commit())
+	v, err = kv.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", v)
+	_, err = kv.Get("b")
+	assert.Error(t, err)
+	v, err = kv.Get("c")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", v)
+	assert.ErrorIs(t, txn.Commit(), errTxnDone)
+
+	// A key read by the transaction was written since it began : none of its writes is made.
+	txn = kv.Begin()
+	_, err = txn.Get("a")
+	assert.NoError(t, err)
+	assert.NoError(t, txn.Set("a", "3"))
+	assert.NoError(t, txn.Set("e", "3"))
+	assert.NoError(t, kv.Set("a", "Other"))
+	assert.ErrorIs(t, txn.Commit(), ErrConflict)
+	v, err = kv.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "Other", v)
+	_, err = kv.Get("e")
+	assert.Error(t, err)
+
+	// A missing key read by the transaction and written since is a conflict as well.
+	txn = kv.Begin()
+	_, err = txn.Get("f")
+	assert.Error(t, err)
+	assert.NoError(t, txn.Set("f", "1"))
+	assert.NoError(t, kv.Set("f", "Other"))
+	assert.ErrorIs(t, txn.Commit(), ErrConflict)
+
+	// The write is found once it is flushed to an SST file.
+	txn = kv.Begin()
+	_, err = txn.Get("a")
+	assert.NoError(t, err)
+	assert.NoError(t, txn.Set("a", "4"))
+	assert.NoError(t, kv.Set("a", "Flushed"))
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, kv.Set(fmt.Sprintf("Filler_%04d", i), strings.Repeat("v", 100)))
+	}
+	kv.flushes.Wait()
+	_, found := kv.memDB.lastWrite("a")
+	assert.False(t, found)
+	assert.ErrorIs(t, txn.Commit(), ErrConflict)
+
+	// A discarded transaction writes nothing.
+	txn = kv.Begin()
+	assert.NoError(t, txn.Set("g", "1"))
+	txn.Discard()
+	assert.ErrorIs(t, txn.Commit(), errTxnDone)
+	_, err = kv.Get("g")
+	assert.Error(t, err)
+}
+
+func TestTxnCounter(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+	assert.NoError(t, kv.Set("counter", "0"))
+
+	// Concurrent increments retried on conflict : none is lost.
+	const workers, increments = 4, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				for {
+					txn := kv.Begin()
+					v, err := txn.Get("counter")
+					assert.NoError(t, err)
+					n, _ := strconv.Atoi(v)
+					assert.NoError(t, txn.Set("counter", strconv.Itoa(n+1)))
+					err = txn.Commit()
+					if err != ErrConflict {
+						assert.NoError(t, err)
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := kv.Get("counter")
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(workers*increments), v)
+}
@@ -1,16 +1,64 @@
 package main
 
+// We will write the structure of the WAL file as follows:
+
+// 1. Magic number (8 bytes)
+// 2. Records, each one written as :
+//    Payload length (4 bytes) | Length checksum (4 bytes) | Checksum (4 bytes) | Payload (the record, encoded as described in
+//    RecordCodec.go)
+
+// The records of the files starting with walMagicTTL are encoded with their sequence number and their expiry (sysVersTTL). The files
+// starting with walMagicSeq were written before the expiries (sysVersSeq encoding), the files starting with walMagic before the
+// sequence numbers (sysVersChecksum encoding) : they are still replayed, but never appended to.
+
+// The length checksum is the CRC32C of the payload length, the checksum the CRC32C of the payload length and of the payload. All the
+// integers are little endian. The length is checked on its own : a record that goes past the end of the file with a valid length
+// was being written during a crash, never one whose length was damaged.
+
+// A write batch (see WriteBatch.go) is a single record whose payload holds all the records of the batch :
+//    walBatch (1 byte) | Number of records (4 bytes) | Records (each one encoded as described in RecordCodec.go)
+// No record starts with the walBatch byte. The batch has a single checksum, so it is replayed whole or not at all.
+
+// The WAL files written before the checksums have no magic number, they hold JSON records prefixed by their length (int64, big
+// endian). They are still replayed, but never appended to (they are older segments, see TreeMap.go).
+
+// A crash in the middle of a write leaves a torn record at the end of the file, the records before it are still valid.
+// ReadRecord returns errTornRecord for such a record, and DropTornTail removes it so that new records can be appended.
+// A bad record followed by valid data is not the result of a crash, ReadRecord returns an ErrCorruption for it.
+
+// WriteRecord syncs the file as required by the durability of the WAL (see Options.go). The WAL tracks how much of the file
+// has been written and how much has been synced: everything before the synced offset survives a power failure.
+
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const walMagic uint64 = 0x57414C0000C5C5C5
+const walMagicSeq uint64 = 0x57414C0001C5C5C5
+const walMagicTTL uint64 = 0x57414C0002C5C5C5
+const walHeaderSize = 8
+const walRecordHeaderSize = 12
+
+// walBatch : The first byte of the payload of a write batch.
+const walBatch byte = 3
+
+var errTornRecord = errors.New("torn record at the end of the WAL")
+
 // WAL interface defines the methods for writing and reading records.
 type WAL interface {
 	WriteRecord(record FileRecord) error
+	WriteRecords(records []FileRecord) error
 	ReadRecord() (FileRecord, error)
 
 	ResetWal() error
@@ -24,6 +72,25 @@ type WALFile struct {
 	hotVals     bool
 	recordCount int
 	file        *os.File
+	// The file was written before the checksums.
+	legacy bool
+	// The system version of the encoding of the records (see RecordCodec.go).
+	version uint64
+	// Offset of the end of the last record read.
+	pos int64
+	// The records of the last batch read, not yet returned by ReadRecord.
+	batch []FileRecord
+
+	durability Durability
+	// Protects the writes to the file.
+	mu      sync.Mutex
+	written atomic.Int64
+	// Held by the writer doing an fsync, protects the synced offset.
+	syncMu sync.Mutex
+	synced int64
+	// Stops the background syncs of SyncInterval.
+	stop chan struct{}
+	done chan struct{}
 }
 
 func NewWALFile(fileName string) (*WALFile, error) {
@@ -31,11 +98,108 @@ func NewWALFile(fileName string) (*WALFile, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &WALFile{file: file}, nil
+	w := &WALFile{file: file, durability: SyncPerWrite, version: sysVers}
+
+	var magic [walHeaderSize]byte
+	n, err := file.ReadAt(magic[:], 0)
+	switch {
+	case n == 0 && err == io.EOF:
+		// A new file.
+		if err := w.writeHeader(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	case n == walHeaderSize && binary.LittleEndian.Uint64(magic[:]) == walMagicTTL:
+	case n == walHeaderSize && binary.LittleEndian.Uint64(magic[:]) == walMagicSeq:
+		w.version = sysVersSeq
+	case n == walHeaderSize && binary.LittleEndian.Uint64(magic[:]) == walMagic:
+		w.version = sysVersChecksum
+	default:
+		w.legacy = true
+		w.version = sysVersJSON
+	}
+
+	// Whatever is already in the file has been loaded, it is considered synced.
+	size, err := w.size()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	w.written.Store(size)
+	w.synced = size
+	return w, nil
+}
+
+// SetDurability sets when the WAL is synced, with SyncInterval a background goroutine syncs the file every interval until Close.
+func (w *WALFile) SetDurability(durability Durability, interval time.Duration) {
+	w.durability = durability
+	if durability != SyncInterval {
+		return
+	}
+
+	w.stop, w.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := w.Sync(); err != nil {
+					fmt.Println("Error syncing the WAL file:", err)
+				}
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Sync forces everything written so far to the disk.
+func (w *WALFile) Sync() error {
+	return w.syncTo(w.written.Load())
+}
+
+// syncTo returns once the file is synced up to offset at least.
+// The writers waiting here while an fsync runs are all covered by the next fsync, only the first of them calls it.
+func (w *WALFile) syncTo(offset int64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	if w.synced >= offset {
+		return nil
+	}
+
+	written := w.written.Load()
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.synced = written
+	return nil
+}
+
+// setSize resets the written and synced offsets after the file has been truncated or replaced.
+func (w *WALFile) setSize(size int64, synced bool) {
+	w.written.Store(size)
+	w.syncMu.Lock()
+	w.synced = 0
+	if synced {
+		w.synced = size
+	}
+	w.syncMu.Unlock()
+}
+
+func (w *WALFile) writeHeader() error {
+	_, err := w.file.WriteAt(binary.LittleEndian.AppendUint64(nil, walMagicTTL), 0)
+	return err
 }
 
 func (w *WALFile) SeekStart() error {
-	_, err := w.file.Seek(0, io.SeekStart)
+	w.pos = walHeaderSize
+	w.batch = nil
+	if w.legacy {
+		w.pos = 0
+	}
+	_, err := w.file.Seek(w.pos, io.SeekStart)
 	if err != nil {
 		fmt.Println("Error seeking to the beginning of the WAL file:", err)
 		return err
@@ -57,8 +221,14 @@ func (w *WALFile) ResetWal() error {
 	if err != nil {
 		return err
 	}
+	w.legacy = false
+	w.version = sysVers
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	w.setSize(walHeaderSize, false)
 
-	_, err = w.file.Seek(0, io.SeekStart)
+	_, err = w.file.Seek(walHeaderSize, io.SeekStart)
 	if err != nil {
 		return err
 	}
@@ -66,60 +236,308 @@ func (w *WALFile) ResetWal() error {
 	return nil
 }
 
+// appendWalFrame appends the payload to buf, framed with its length and the checksums.
+func appendWalFrame(buf []byte, payload []byte) []byte {
+	start := len(buf)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+	lengthCRC := crc32.Checksum(buf[start:], crcTable)
+	crc := crc32.Update(lengthCRC, crcTable, payload)
+	buf = binary.LittleEndian.AppendUint32(buf, lengthCRC)
+	buf = binary.LittleEndian.AppendUint32(buf, crc)
+	return append(buf, payload...)
+}
+
+// appendWalRecord appends the framed record (length, checksum, payload) to buf.
+func appendWalRecord(buf []byte, record FileRecord) ([]byte, error) {
+	payload, err := appendRecord(nil, sysVers, record)
+	if err != nil {
+		return buf, err
+	}
+	return appendWalFrame(buf, payload), nil
+}
+
+// appendWalBatch appends the records to buf as a single framed record.
+func appendWalBatch(buf []byte, records []FileRecord) ([]byte, error) {
+	payload := []byte{walBatch}
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(len(records)))
+	for _, record := range records {
+		var err error
+		if payload, err = appendRecord(payload, sysVers, record); err != nil {
+			return buf, err
+		}
+	}
+	return appendWalFrame(buf, payload), nil
+}
+
+// WriteRecord appends the record to the WAL, and returns once it is as durable as required by the durability of the WAL.
 func (w *WALFile) WriteRecord(record FileRecord) error {
+	return w.WriteRecords([]FileRecord{record})
+}
 
-	// First seek the end of the File.
-	if err := w.SeekEnd(); err != nil {
-		return err
+// WriteRecords appends the records to the WAL with a single write, and returns once they are as durable as required by the
+// durability of the WAL.
+func (w *WALFile) WriteRecords(records []FileRecord) error {
+	if w.legacy {
+		return errors.New("cannot append to a WAL written before the checksums")
 	}
 
-	// Convert record to JSON
-	data, err := json.Marshal(record)
+	var data []byte
+	for _, record := range records {
+		var err error
+		if data, err = appendWalRecord(data, record); err != nil {
+			return err
+		}
+	}
+	return w.writeFrames(data)
+}
+
+// WriteBatch appends the records to the WAL as a single record, see above.
+func (w *WALFile) WriteBatch(records []FileRecord) error {
+	if w.legacy {
+		return errors.New("cannot append to a WAL written before the checksums")
+	}
+
+	data, err := appendWalBatch(nil, records)
 	if err != nil {
 		return err
 	}
+	return w.writeFrames(data)
+}
 
-	// Write the length of the record
-	if err := binary.Write(w.file, binary.BigEndian, int64(len(data))); err != nil {
+// writeFrames appends the framed payloads to the file with a single write, and returns once they are as durable as required by
+// the durability of the WAL.
+func (w *WALFile) writeFrames(data []byte) error {
+	if w.version != sysVers {
+		return errors.New("cannot append to a WAL written with an older format")
+	}
+	w.mu.Lock()
+	// First seek the end of the File.
+	if err := w.SeekEnd(); err != nil {
+		w.mu.Unlock()
 		return err
 	}
 
-	// Write the record data
-	_, err = w.file.Write(data)
-	if err != nil {
+	// Write all the records at once.
+	if _, err := w.file.Write(data); err != nil {
+		w.mu.Unlock()
 		return err
 	}
+	end := w.written.Add(int64(len(data)))
+
+	if w.durability == SyncPerWrite {
+		// Each write has its own fsync, the next write waits for it.
+		defer w.mu.Unlock()
+		return w.syncTo(end)
+	}
+	w.mu.Unlock()
 
+	if w.durability == SyncGroup {
+		return w.syncTo(end)
+	}
 	return nil
 }
 
+// ReadRecord returns the next record of the WAL. The records of a batch are returned one by one, once the whole batch is read and
+// checked.
 func (w *WALFile) ReadRecord() (FileRecord, error) {
+	if w.legacy {
+		return w.readLegacyRecord()
+	}
+
+	for len(w.batch) == 0 {
+		data, end, err := w.readFrame()
+		if err != nil {
+			return FileRecord{}, err
+		}
+
+		r := bytes.NewReader(data)
+		if len(data) > 0 && data[0] == walBatch {
+			w.batch, err = readBatch(r, w.version)
+		} else {
+			var record FileRecord
+			record, err = readRecord(r, w.version)
+			w.batch = []FileRecord{record}
+		}
+		if err != nil || r.Len() != 0 {
+			w.batch = nil
+			return FileRecord{}, &ErrCorruption{File: w.file.Name(), Offset: w.pos, Reason: "undecodable WAL record"}
+		}
+		w.pos = end
+	}
+
+	record := w.batch[0]
+	w.batch = w.batch[1:]
+	return record, nil
+}
+
+// readBatch decodes the records of a batch payload.
+func readBatch(r *bytes.Reader, version uint64) ([]FileRecord, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(hdr[1:])
+	records := make([]FileRecord, 0, min(int(n), r.Len()))
+	for i := uint32(0); i < n; i++ {
+		record, err := readRecord(r, version)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// readFrame reads the payload of the next framed record, and returns it with the offset of the end of the record.
+func (w *WALFile) readFrame() ([]byte, int64, error) {
+	// Read the length and the checksum of the record
+	var header [walRecordHeaderSize]byte
+	if _, err := io.ReadFull(w.file, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errTornRecord
+		}
+		return nil, 0, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:])
+	lengthCRC := crc32.Checksum(header[0:4], crcTable)
+
+	size, err := w.size()
+	if err != nil {
+		return nil, 0, err
+	}
+	if lengthCRC != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, 0, w.badRecord(w.pos+walRecordHeaderSize, size, "WAL record length checksum mismatch")
+	}
+
+	// A record with a valid length that goes past the end of the file was being written during a crash.
+	end := w.pos + walRecordHeaderSize + int64(length)
+	if end > size {
+		return nil, 0, errTornRecord
+	}
+
+	// Read the record data
+	data := make([]byte, length)
+	if _, err := io.ReadFull(w.file, data); err != nil {
+		return nil, 0, err
+	}
+
+	crc := crc32.Update(lengthCRC, crcTable, data)
+	if crc != binary.LittleEndian.Uint32(header[8:]) {
+		return nil, 0, w.badRecord(end, size, "WAL record checksum mismatch")
+	}
+	return data, end, nil
+}
+
+// readLegacyRecord reads a record written before the checksums, a torn record can only be detected if it is truncated or if its
+// JSON is invalid.
+func (w *WALFile) readLegacyRecord() (FileRecord, error) {
 	// Read the length of the record
 	var length int64
 	if err := binary.Read(w.file, binary.BigEndian, &length); err != nil {
 		if err == io.EOF {
 			return FileRecord{}, io.EOF
 		}
+		if err == io.ErrUnexpectedEOF {
+			return FileRecord{}, errTornRecord
+		}
+		return FileRecord{}, err
+	}
+
+	size, err := w.size()
+	if err != nil {
 		return FileRecord{}, err
 	}
+	end := w.pos + 8 + length
+	if length < 0 || end > size {
+		return FileRecord{}, errTornRecord
+	}
 
 	// Read the record data
 	data := make([]byte, length)
-	_, err := io.ReadFull(w.file, data)
-	if err != nil {
+	if _, err := io.ReadFull(w.file, data); err != nil {
 		return FileRecord{}, err
 	}
 
 	// Unmarshal the JSON data into a WALRecord
 	var record FileRecord
-	err = json.Unmarshal(data, &record)
-	if err != nil {
-		return FileRecord{}, err
+	if err := json.Unmarshal(data, &record); err != nil {
+		return FileRecord{}, w.badRecord(end, size, "invalid JSON WAL record")
 	}
 
+	w.pos = end
 	return record, nil
 }
 
+// badRecord decides if the bad record starting at w.pos and ending at end is a torn record or a corruption in the middle of the log.
+// A torn record is the last one of the file, or is only followed by zeros (some file systems extend the file before a crash).
+func (w *WALFile) badRecord(end, size int64, reason string) error {
+	if end == size {
+		return errTornRecord
+	}
+	rest, err := io.ReadAll(io.NewSectionReader(w.file, end, size-end))
+	if err != nil {
+		return err
+	}
+	for _, b := range rest {
+		if b != 0 {
+			return &ErrCorruption{File: w.file.Name(), Offset: w.pos, Reason: reason}
+		}
+	}
+	return errTornRecord
+}
+
+// DropTornTail truncates the file after the last record read, and returns the number of bytes dropped.
+// It must be called after ReadRecord returned errTornRecord.
+func (w *WALFile) DropTornTail() (int64, error) {
+	size, err := w.size()
+	if err != nil {
+		return 0, err
+	}
+	if err := w.file.Truncate(w.pos); err != nil {
+		return 0, err
+	}
+	if err := w.SeekEnd(); err != nil {
+		return 0, err
+	}
+	w.setSize(w.pos, true)
+	return size - w.pos, nil
+}
+
+func (w *WALFile) size() (int64, error) {
+	info, err := w.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Close stops the background syncs and syncs the file before closing it.
 func (w *WALFile) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+		w.stop = nil
+	}
+	if err := w.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
 	return w.file.Close()
 }
+
+// syncDir makes the creation, deletion and renaming of the files of the directory durable.
+func syncDir(dir string) error {
+	// Directories cannot be synced on Windows, the renames are durable once they return.
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -59,3 +65,337 @@ func TestWALFile(t *testing.T) {
 	assert.Equal(t, io.EOF, err)
 	assert.Equal(t, FileRecord{}, emptyRecord)
 }
+
+// newTestWAL creates the first WAL segment of a temporary directory, holding the given records.
+func newTestWAL(t *testing.T, records []FileRecord) *WALFile {
+	wal, err := NewWALFile(segmentName(t.TempDir(), 1))
+	assert.NoError(t, err)
+	t.Cleanup(func() { wal.Close() })
+	for _, r := range records {
+		assert.NoError(t, wal.WriteRecord(r))
+	}
+	return wal
+}
+
+// openTestPersMem opens the main memory backed by the WAL segments of dir.
+func openTestPersMem(t *testing.T, dir string) *PersMem {
+	mem, err := newPersMem(dir, DefaultOptions())
+	assert.NoError(t, err)
+	t.Cleanup(func() { mem.Close() })
+	return mem
+}
+
+func testRecords(n int) []FileRecord {
+	var records []FileRecord
+	for i := 0; i < n; i++ {
+		records = append(records, FileRecord{Operation: Put, Key: fmt.Sprintf("Key_%d", i), Value: fmt.Sprintf("Value_%d", i)})
+	}
+	return records
+}
+
+func TestWALTornTail(t *testing.T) {
+	records := testRecords(10)
+	wal := newTestWAL(t, records)
+	size, err := wal.size()
+	assert.NoError(t, err)
+
+	// The last record was cut during a crash.
+	assert.NoError(t, wal.file.Truncate(size-3))
+
+	mem := openTestPersMem(t, filepath.Dir(wal.file.Name()))
+	assert.NoError(t, mem.Load())
+
+	last, err := appendWalRecord(nil, records[9])
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(last)-3), mem.droppedBytes)
+	assert.Equal(t, 9, mem.store.Len())
+	_, err = mem.GetM("Key_9")
+	assert.Error(t, err)
+
+	// New records are appended after the last valid one.
+	assert.NoError(t, mem.SetM("Key_9", "Value_9"))
+	mem.store.Clear()
+	assert.NoError(t, mem.Load())
+	assert.Equal(t, int64(0), mem.droppedBytes)
+	assert.Equal(t, 10, mem.store.Len())
+}
+
+func TestWALTornTailHoldingAFrame(t *testing.T) {
+	// The value of the last record holds a whole framed record.
+	frame, err := appendWalRecord(nil, testRecords(1)[0])
+	assert.NoError(t, err)
+	records := append(testRecords(3), FileRecord{Operation: Put, Key: "Frame", Value: string(frame) + "tail"})
+	wal := newTestWAL(t, records)
+	size, err := wal.size()
+	assert.NoError(t, err)
+	assert.NoError(t, wal.file.Truncate(size-10))
+
+	// It is still a torn record.
+	mem := openTestPersMem(t, filepath.Dir(wal.file.Name()))
+	assert.NoError(t, mem.Load())
+	assert.Greater(t, mem.droppedBytes, int64(0))
+	assert.Equal(t, 3, mem.store.Len())
+}
+
+func TestWALZeroTail(t *testing.T) {
+	wal := newTestWAL(t, testRecords(5))
+
+	// Some file systems leave zeros after the last record.
+	size, err := wal.size()
+	assert.NoError(t, err)
+	_, err = wal.file.WriteAt(make([]byte, 100), size)
+	assert.NoError(t, err)
+
+	mem := openTestPersMem(t, filepath.Dir(wal.file.Name()))
+	assert.NoError(t, mem.Load())
+	assert.Equal(t, int64(100), mem.droppedBytes)
+	assert.Equal(t, 5, mem.store.Len())
+}
+
+func TestWALCorruptionInTheMiddle(t *testing.T) {
+	wal := newTestWAL(t, testRecords(5))
+
+	// Flip a bit in the value of the second record.
+	first, err := appendWalRecord(nil, testRecords(1)[0])
+	assert.NoError(t, err)
+	offset := int64(walHeaderSize+len(first)) + walRecordHeaderSize + 3
+	b := make([]byte, 1)
+	_, err = wal.file.ReadAt(b, offset)
+	assert.NoError(t, err)
+	b[0] ^= 0x10
+	_, err = wal.file.WriteAt(b, offset)
+	assert.NoError(t, err)
+
+	mem := openTestPersMem(t, filepath.Dir(wal.file.Name()))
+	err = mem.Load()
+	var corrupt *ErrCorruption
+	assert.ErrorAs(t, err, &corrupt)
+	assert.Equal(t, wal.file.Name(), corrupt.File)
+	assert.Equal(t, int64(walHeaderSize+len(first)), corrupt.Offset)
+}
+
+func TestWALDamagedLength(t *testing.T) {
+	wal := newTestWAL(t, testRecords(10))
+
+	// Flip a bit in the length of the second record : it seems to go past the end of the file.
+	first, err := appendWalRecord(nil, testRecords(1)[0])
+	assert.NoError(t, err)
+	offset := int64(walHeaderSize+len(first)) + 2
+	b := make([]byte, 1)
+	_, err = wal.file.ReadAt(b, offset)
+	assert.NoError(t, err)
+	b[0] ^= 0x10
+	_, err = wal.file.WriteAt(b, offset)
+	assert.NoError(t, err)
+
+	// Valid records follow it, it is not a torn record.
+	mem := openTestPersMem(t, filepath.Dir(wal.file.Name()))
+	err = mem.Load()
+	var corrupt *ErrCorruption
+	assert.ErrorAs(t, err, &corrupt)
+	assert.Equal(t, int64(walHeaderSize+len(first)), corrupt.Offset)
+	assert.Equal(t, int64(0), mem.droppedBytes)
+}
+
+func TestWALLegacyFormat(t *testing.T) {
+	// Write a WAL with the format used before the checksums and the segments.
+	dir := t.TempDir()
+	name := dir + "/mydb.wal"
+	var data []byte
+	for _, r := range testRecords(3) {
+		js, err := json.Marshal(r)
+		assert.NoError(t, err)
+		data = binary.BigEndian.AppendUint64(data, uint64(len(js)))
+		data = append(data, js...)
+	}
+	assert.NoError(t, os.WriteFile(name, data, 0644))
+
+	// It becomes the first segment.
+	walDir := dir + "/" + walDirectory
+	assert.NoError(t, adoptLegacyWAL(name, walDir))
+	_, err := os.Stat(segmentName(walDir, 1))
+	assert.NoError(t, err)
+
+	mem := openTestPersMem(t, walDir)
+	assert.NoError(t, mem.Load())
+	assert.Equal(t, 3, mem.store.Len())
+	// The records written without sequence numbers are numbered in the order of the log.
+	assert.Equal(t, uint64(3), mem.seq)
+
+	// The new records go to a new segment.
+	assert.NoError(t, mem.SetM("Key_3", "Value_3"))
+	mem.store.Clear()
+	assert.NoError(t, mem.Load())
+	assert.Equal(t, 4, mem.store.Len())
+}
+
+// newSegment starts a new segment as freeze does, the records written so far stay in the main memory.
+func (s *PersMem) newSegment() ([]uint64, uint64, error) {
+	var old []uint64
+	var seq uint64
+	err := s.commitAlone(func() error {
+		var err error
+		old, seq, err = s.switchSegment()
+		return err
+	})
+	return old, seq, err
+}
+
+func TestWALSegments(t *testing.T) {
+	dir := t.TempDir()
+	mem := openTestPersMem(t, dir)
+	for _, r := range testRecords(5) {
+		assert.NoError(t, mem.SetM(r.Key, r.Value))
+	}
+
+	// The records written so far are in the old segment, the next ones in a new segment.
+	old, _, err := mem.newSegment()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1}, old)
+	assert.NoError(t, mem.SetM("Key_5", "Value_5"))
+	segments, err := listSegments(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2}, segments)
+
+	// Until the old segment is dropped all the records are replayed.
+	mem2 := openTestPersMem(t, dir)
+	assert.NoError(t, mem2.Load())
+	assert.Equal(t, 6, mem2.store.Len())
+
+	// Once it is dropped only the records of the live segments are replayed.
+	assert.NoError(t, mem.dropSegments(old))
+	mem3 := openTestPersMem(t, dir)
+	assert.NoError(t, mem3.Load())
+	assert.Equal(t, 1, mem3.store.Len())
+}
+
+func TestWALSkipSegments(t *testing.T) {
+	dir := t.TempDir()
+	mem := openTestPersMem(t, dir)
+	assert.NoError(t, mem.SetM("Key_0", "Value_0"))
+	_, _, err := mem.newSegment()
+	assert.NoError(t, err)
+	assert.NoError(t, mem.SetM("Key_1", "Value_1"))
+	assert.NoError(t, mem.Close())
+
+	// The MANIFEST says that the segments below 2 are in the SST files.
+	mem = openTestPersMem(t, dir)
+	assert.NoError(t, mem.skipSegments(2))
+	assert.Equal(t, []uint64{2, 3}, mem.live)
+	assert.NoError(t, mem.Load())
+	assert.Equal(t, 1, mem.store.Len())
+	// The sequence number is the one written with the record.
+	assert.Equal(t, uint64(2), mem.seq)
+
+	// A segment numbered below logNum is never reused for the new records.
+	dir = t.TempDir()
+	mem = openTestPersMem(t, dir)
+	assert.NoError(t, mem.skipSegments(5))
+	assert.Equal(t, []uint64{5}, mem.live)
+	segments, err := listSegments(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{5}, segments)
+}
+
+func TestWALTornSegmentFollowedByRecords(t *testing.T) {
+	wal := newTestWAL(t, testRecords(3))
+	dir := filepath.Dir(wal.file.Name())
+	size, err := wal.size()
+	assert.NoError(t, err)
+	assert.NoError(t, wal.file.Truncate(size-3))
+
+	// A newer segment holds records : the torn record is not the end of the log.
+	newer, err := NewWALFile(segmentName(dir, 2))
+	assert.NoError(t, err)
+	assert.NoError(t, newer.WriteRecord(testRecords(1)[0]))
+	newer.Close()
+
+	mem := openTestPersMem(t, dir)
+	var corrupt *ErrCorruption
+	assert.ErrorAs(t, mem.Load(), &corrupt)
+}
+
+// simulateCrash closes the WAL without syncing it and drops everything that was not synced, as a power failure could.
+// It returns the records that survived.
+func simulateCrash(t *testing.T, wal *WALFile) []FileRecord {
+	if wal.stop != nil {
+		close(wal.stop)
+		<-wal.done
+		wal.stop = nil
+	}
+	wal.syncMu.Lock()
+	synced := wal.synced
+	wal.syncMu.Unlock()
+	name := wal.file.Name()
+	wal.file.Close()
+	assert.NoError(t, os.Truncate(name, synced))
+
+	reopened, err := NewWALFile(name)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	reopened.SeekStart()
+	var records []FileRecord
+	for {
+		r, err := reopened.ReadRecord()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			return records
+		}
+		records = append(records, r)
+	}
+}
+
+func TestDurabilitySyncPerWrite(t *testing.T) {
+	wal := newTestWAL(t, nil)
+	wal.SetDurability(SyncPerWrite, 0)
+
+	records := testRecords(20)
+	for _, r := range records {
+		assert.NoError(t, wal.WriteRecord(r))
+	}
+
+	// Every acknowledged write survives.
+	assert.Equal(t, records, simulateCrash(t, wal))
+}
+
+func TestDurabilitySyncGroup(t *testing.T) {
+	wal := newTestWAL(t, nil)
+	wal.SetDurability(SyncGroup, 0)
+
+	// Concurrent writers share the syncs.
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				r := FileRecord{Operation: Put, Key: fmt.Sprintf("Key_%d_%d", g, i), Value: "Value"}
+				assert.NoError(t, wal.WriteRecord(r))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// Every acknowledged write survives.
+	assert.Len(t, simulateCrash(t, wal), 200)
+}
+
+func TestDurabilitySyncInterval(t *testing.T) {
+	// With a long interval nothing is synced yet : the acknowledged writes are lost.
+	wal := newTestWAL(t, nil)
+	wal.SetDurability(SyncInterval, time.Hour)
+	for _, r := range testRecords(10) {
+		assert.NoError(t, wal.WriteRecord(r))
+	}
+	assert.Empty(t, simulateCrash(t, wal))
+
+	// Once an interval has passed the writes survive.
+	wal = newTestWAL(t, nil)
+	wal.SetDurability(SyncInterval, 10*time.Millisecond)
+	records := testRecords(10)
+	for _, r := range records {
+		assert.NoError(t, wal.WriteRecord(r))
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, records, simulateCrash(t, wal))
+}
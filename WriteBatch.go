@@ -0,0 +1,64 @@
+package main
+
+// A write batch collects puts and deletes that are written together : the batch is a single record of the WAL (see WAL.go), with a
+// single checksum, so after a crash Load replays all of it or nothing. It is applied to the main memory at once : its records are
+// only seen by the reads once they are all applied (see Snapshot.go).
+
+// WriteBatch : Puts and deletes written at once by MyKvStore.Write, in the order they were added.
+type WriteBatch struct {
+	records []FileRecord
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put adds the value of the key to the batch.
+func (b *WriteBatch) Put(key string, val string) {
+	b.records = append(b.records, FileRecord{Operation: Put, Key: key, Value: val})
+}
+
+// Delete adds the deletion of the key to the batch.
+func (b *WriteBatch) Delete(key string) {
+	b.records = append(b.records, FileRecord{Operation: Del, Key: key})
+}
+
+// Len returns the number of puts and deletes of the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.records)
+}
+
+// Reset empties the batch, so that it can be used again.
+func (b *WriteBatch) Reset() {
+	b.records = b.records[:0]
+}
+
+// WriteM writes the records of the batch through the group commit, as a single WAL record.
+func (s *PersMem) WriteM(b *WriteBatch) error {
+	records := append([]FileRecord(nil), b.records...)
+	return s.commitBatch(records, s.applyBatch(records))
+}
+
+// WriteIf writes the records of the batch as WriteM does if check succeeds, no other write is applied between check and the batch.
+func (s *PersMem) WriteIf(b *WriteBatch, check func() error) error {
+	records := append([]FileRecord(nil), b.records...)
+	return s.commitBatchChecked(records, check, s.applyBatch(records))
+}
+
+func (s *PersMem) applyBatch(records []FileRecord) func() error {
+	return func() error {
+		for _, r := range records {
+			s.store.Set(r.Key, Tuple{string(r.Operation), r.Value, r.Expiry}, r.Seq)
+		}
+		return nil
+	}
+}
+
+// Write writes all the puts and deletes of the batch, or none of them.
+func (kv *MyKvStore) Write(b *WriteBatch) error {
+	defer kv.CheckIfFlush()
+	if b.Len() == 0 {
+		return nil
+	}
+	return kv.memDB.WriteM(b)
+}
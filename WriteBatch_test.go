@@ -0,0 +1,115 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	mem := openTestPersMem(t, dir)
+	assert.NoError(t, mem.SetM("a", "Old"))
+	assert.NoError(t, mem.SetM("b", "Old"))
+
+	b := NewWriteBatch()
+	b.Put("a", "New")
+	b.Delete("b")
+	b.Put("c", "1")
+	b.Put("c", "2")
+	assert.Equal(t, 4, b.Len())
+	assert.NoError(t, mem.WriteM(b))
+	assert.Equal(t, uint64(6), mem.seq)
+
+	check := func(mem *PersMem) {
+		v, err := mem.GetM("a")
+		assert.NoError(t, err)
+		assert.Equal(t, Tuple{"set", "New", 0}, v)
+		v, err = mem.GetM("b")
+		assert.NoError(t, err)
+		assert.Equal(t, Tuple{"del", "", 0}, v)
+		v, err = mem.GetM("c")
+		assert.NoError(t, err)
+		assert.Equal(t, Tuple{"set", "2", 0}, v)
+	}
+	check(mem)
+
+	// The batch is replayed after a restart, with the records written around it.
+	b.Reset()
+	b.Put("d", "1")
+	assert.NoError(t, mem.WriteM(b))
+	assert.NoError(t, mem.SetM("e", "1"))
+	mem.Close()
+	mem = openTestPersMem(t, dir)
+	assert.NoError(t, mem.Load())
+	check(mem)
+	assert.Equal(t, 5, mem.store.Len())
+	assert.Equal(t, uint64(8), mem.seq)
+}
+
+func TestWriteBatchTorn(t *testing.T) {
+	dir := t.TempDir()
+	mem := openTestPersMem(t, dir)
+	assert.NoError(t, mem.SetM("a", "1"))
+	b := NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		b.Put("Key_"+strconv.Itoa(i), "Value")
+	}
+	assert.NoError(t, mem.WriteM(b))
+
+	// The end of the batch was cut during a crash : none of its records is replayed.
+	size, err := mem.wal.size()
+	assert.NoError(t, err)
+	assert.NoError(t, mem.wal.file.Truncate(size-10))
+	name := mem.wal.file.Name()
+	mem.Close()
+
+	mem = openTestPersMem(t, filepath.Dir(name))
+	assert.NoError(t, mem.Load())
+	assert.Equal(t, 1, mem.store.Len())
+	assert.Greater(t, mem.droppedBytes, int64(100*len("Key_00Value")))
+}
+
+func TestWriteBatchAtomic(t *testing.T) {
+	kv := openTestStore(t)
+	defer kv.Stop()
+
+	// Each batch writes the same value to both keys, a reads first then b : b is never older than a.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				a, errA := kv.Get("a")
+				b, errB := kv.Get("b")
+				if errA != nil {
+					continue
+				}
+				assert.NoError(t, errB)
+				na, _ := strconv.Atoi(a)
+				nb, _ := strconv.Atoi(b)
+				assert.LessOrEqual(t, na, nb)
+			}
+		}()
+	}
+
+	b := NewWriteBatch()
+	for i := 0; i < 2000; i++ {
+		b.Reset()
+		b.Put("a", strconv.Itoa(i))
+		b.Put("b", strconv.Itoa(i))
+		assert.NoError(t, kv.Write(b))
+	}
+	close(done)
+	wg.Wait()
+}
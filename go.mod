@@ -2,12 +2,10 @@ module KV_Store
 
 go 1.21.3
 
-require github.com/igrmk/treemap/v2 v2.0.1
+require github.com/stretchr/testify v1.8.4
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.8.4 // indirect
-	golang.org/x/exp v0.0.0-20220317015231-48e79f11773a // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
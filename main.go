@@ -1,25 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-)
-
-type Error int
-
-func (e Error) Error() string {
-	switch e {
-	case KeyNotFound:
-		return "Key Not Found"
-	case KeyDeleted:
-		return "Key Deleted"
-	}
-	return "Unknown Error"
-}
-
-const (
-	KeyNotFound Error = iota
-	KeyDeleted
+	"strconv"
+	"time"
 )
 
 type HTTP_API_DB struct {
@@ -33,7 +19,7 @@ func (api *HTTP_API_DB) HandleGet(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 	val, err := api.db.Get(key)
 
-	if err == KeyNotFound || err == KeyDeleted {
+	if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrKeyDeleted) {
 		fmt.Fprint(w, "Key not found")
 		return
 	} else if err != nil {
@@ -62,7 +48,20 @@ func (api *HTTP_API_DB) HandleSet(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing 'value' parameter", http.StatusBadRequest)
 		return
 	}
-	if err := api.db.Set(key, value); err != nil {
+
+	// The optional ttl is a number of seconds, the value expires once it has passed.
+	var err error
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		seconds, perr := strconv.Atoi(ttl)
+		if perr != nil || seconds <= 0 {
+			http.Error(w, "Invalid 'ttl' parameter", http.StatusBadRequest)
+			return
+		}
+		err = api.db.SetWithTTL(key, value, time.Duration(seconds)*time.Second)
+	} else {
+		err = api.db.Set(key, value)
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -89,6 +88,65 @@ func (api *HTTP_API_DB) HandleDel(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(val))
 }
 
+// HandleCAS handles the compare-and-swap requests, 412 when the key doesn't have the expected value.
+func (api *HTTP_API_DB) HandleCAS(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	expected := r.URL.Query().Get("expected")
+	value := r.URL.Query().Get("value")
+
+	if key == "" {
+		http.Error(w, "Missing 'key' parameter", http.StatusBadRequest)
+		return
+	}
+	if value == "" {
+		http.Error(w, "Missing 'value' parameter", http.StatusBadRequest)
+		return
+	}
+	writeConditional(w, api.db.CompareAndSwap(key, expected, value))
+}
+
+// HandleSetIfAbsent handles the set-if-absent requests, 409 when the key already has a value.
+func (api *HTTP_API_DB) HandleSetIfAbsent(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	value := r.URL.Query().Get("value")
+
+	if key == "" {
+		http.Error(w, "Missing 'key' parameter", http.StatusBadRequest)
+		return
+	}
+	if value == "" {
+		http.Error(w, "Missing 'value' parameter", http.StatusBadRequest)
+		return
+	}
+	writeConditional(w, api.db.SetIfAbsent(key, value))
+}
+
+// HandleDeleteIfEquals handles the conditional deletions, 412 when the key doesn't have the expected value.
+func (api *HTTP_API_DB) HandleDeleteIfEquals(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	expected := r.URL.Query().Get("expected")
+
+	if key == "" {
+		http.Error(w, "Missing 'key' parameter", http.StatusBadRequest)
+		return
+	}
+	writeConditional(w, api.db.DeleteIfEquals(key, expected))
+}
+
+// writeConditional writes the response of a conditional write.
+func writeConditional(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ErrKeyExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrValueMismatch):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (api *HTTP_API_DB) HandleStop(w http.ResponseWriter, r *http.Request) {
 
 	err := api.db.Stop()
@@ -105,6 +163,9 @@ func (api *HTTP_API_DB) Start() {
 	http.HandleFunc("/get", api.HandleGet)
 	http.HandleFunc("/set", api.HandleSet)
 	http.HandleFunc("/del", api.HandleDel)
+	http.HandleFunc("/cas", api.HandleCAS)
+	http.HandleFunc("/setifabsent", api.HandleSetIfAbsent)
+	http.HandleFunc("/delifequals", api.HandleDeleteIfEquals)
 	http.HandleFunc("/stop", api.HandleStop)
 	fmt.Print("Starting server on :" + api.port + "...\n")
 
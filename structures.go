@@ -1,17 +1,41 @@
 package main
 
+import "fmt"
+
 // Operation : <string>
 type Operation string
 
-// FileRecord : <Operation, string, string>
+// FileRecord : <Operation, string, string, uint64, int64>
 type FileRecord struct {
 	Operation Operation
 	Key       string
 	Value     string
+	// Sequence number of the write, 0 for the records written before the sequence numbers.
+	Seq uint64 `json:",omitempty"`
+	// Time the value expires at (Unix nanoseconds), 0 for a value that never expires.
+	Expiry int64 `json:",omitempty"`
+}
+
+// expired reports whether the record is a value expired at now : it is read as a deletion of its key.
+func (r FileRecord) expired(now int64) bool {
+	return r.Operation == Put && r.Expiry != 0 && r.Expiry <= now
 }
 
 const (
 	WalName string    = "mydb.wal"
 	Put     Operation = "set"
 	Del     Operation = "del"
+	// An operand folded into the value of the key by the merge operator of the store (see Merge.go).
+	Merge Operation = "merge"
 )
+
+// ErrCorruption is returned when a file doesn't hold what it should (bad magic number, bad checksum, truncated data ...).
+type ErrCorruption struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+func (e *ErrCorruption) Error() string {
+	return fmt.Sprintf("corruption in %s at offset %d: %s", e.File, e.Offset, e.Reason)
+}
@@ -18,7 +18,7 @@ func TestPersMem(t *testing.T) {
 
 	value, err := cache.GetM("testKey")
 	assert.NoError(t, err)
-	assert.Equal(t, Tuple{"set", "testValue"}, value)
+	assert.Equal(t, Tuple{"set", "testValue", 0}, value)
 
 	// Test DelM
 	deletedValue, err := cache.DelM("testKey")
@@ -32,7 +32,7 @@ func TestPersMem(t *testing.T) {
 	// Test GetM after deletion
 	tupl, err := cache.GetM("testKey")
 	assert.NoError(t, err)
-	assert.Equal(t, Tuple{"del", ""}, tupl)
+	assert.Equal(t, Tuple{"del", "", 0}, tupl)
 
 	// Test Clear
 	err = cache.Clear()
@@ -42,3 +42,46 @@ func TestPersMem(t *testing.T) {
 	_, err = cache.GetM("testKey")
 	assert.Error(t, err, "Key Not found In MemDB")
 }
+
+func TestPersMemFreeze(t *testing.T) {
+	mem, err := newPersMem(t.TempDir(), DefaultOptions())
+	assert.NoError(t, err)
+	defer mem.Close()
+
+	assert.NoError(t, mem.SetM("a", "1"))
+	assert.NoError(t, mem.SetM("b", "1"))
+	old, seq, err := mem.freeze()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1}, old)
+	assert.Equal(t, uint64(2), seq)
+	assert.Equal(t, 0, mem.Len())
+
+	// The frozen records are still found, the newer ones first.
+	assert.NoError(t, mem.SetM("b", "2"))
+	assert.NoError(t, mem.DelM1("a"))
+	assert.NoError(t, mem.SetM("c", "2"))
+	assert.Equal(t, 3, mem.Len())
+	v, err := mem.GetM("b")
+	assert.NoError(t, err)
+	assert.Equal(t, Tuple{"set", "2", 0}, v)
+	assert.NoError(t, mem.DelM1("b"))
+	deleted, err := mem.DelM("c")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", deleted)
+
+	// A flush that failed puts the frozen records back, under the newer ones.
+	mem.SetM("d", "2")
+	mem.thaw()
+	assert.Nil(t, mem.imm)
+	assert.Equal(t, 4, mem.Len())
+	v, err = mem.GetM("a")
+	assert.NoError(t, err)
+	assert.Equal(t, Tuple{"del", "", 0}, v)
+
+	// Once flushed, the frozen records are gone from the memory.
+	_, _, err = mem.freeze()
+	assert.NoError(t, err)
+	mem.dropImmutable()
+	_, err = mem.GetM("d")
+	assert.Error(t, err)
+}